@@ -0,0 +1,242 @@
+// Copyright 2020 Blues Inc.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+// Token-based access control.  A target is claimed by issuing it a token, after
+// which it may be accessed only by presenting one of its tokens, either as a
+// bearer token in the Authorization header or as ?key=.  Targets that have not
+// been claimed remain open to all.  Only hashes of tokens are kept.
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Scopes of access, each of which grants those before it
+const (
+	scopeRead  = "read"
+	scopeWrite = "write"
+	scopeAdmin = "admin"
+)
+
+var scopeRank = map[string]int{scopeRead: 1, scopeWrite: 2, scopeAdmin: 3}
+
+// The blob in which tokens are kept
+const authBlobName = ".tokens.json"
+
+// A token issued for a target
+type authToken struct {
+	ID      string `json:"id"`
+	Hash    string `json:"hash,omitempty"`
+	Scope   string `json:"scope"`
+	Name    string `json:"name,omitempty"`
+	Created string `json:"created"`
+}
+
+// Tokens by target
+var authLock sync.Mutex
+var authTokens = map[string][]authToken{}
+
+// Hash a token as kept
+func authHash(token string) string {
+	hash := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(hash[:])
+}
+
+// Load the tokens
+func authLoad() {
+
+	contents, err := store.GetBlob(authBlobName)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			fmt.Printf("auth: can't load tokens: %s\n", err)
+		}
+		return
+	}
+
+	authLock.Lock()
+	err = json.Unmarshal(contents, &authTokens)
+	authLock.Unlock()
+	if err != nil {
+		fmt.Printf("auth: can't parse tokens: %s\n", err)
+	}
+
+}
+
+// Save the tokens, with the lock held
+func authSave() (err error) {
+	contents, err := json.Marshal(authTokens)
+	if err != nil {
+		return
+	}
+	return store.PutBlob(authBlobName, contents, false)
+}
+
+// Get the target that owns a request's target, which is the first component
+// of its path, so that a target's files and rejected posts are protected
+// along with the target itself
+func authOwner(target string) string {
+	return cleanTarget(strings.Split(target, "/")[0])
+}
+
+// Get the token presented with a request, if any
+func authPresented(httpReq *http.Request, args map[string]string) (token string) {
+	auth := httpReq.Header.Get("Authorization")
+	if len(auth) > 7 && strings.EqualFold(auth[:7], "Bearer ") {
+		return strings.TrimSpace(auth[7:])
+	}
+	return args["key"]
+}
+
+// Get the scope that a token grants for a target, if any.  A target that has
+// not been claimed grants all access to everyone, and the service's admin
+// token grants all access to every target.
+func authScope(target string, token string) (scope string) {
+
+	if Config.AdminToken != "" && token != "" && subtle.ConstantTimeCompare([]byte(token), []byte(Config.AdminToken)) == 1 {
+		return scopeAdmin
+	}
+
+	authLock.Lock()
+	defer authLock.Unlock()
+
+	tokens := authTokens[authOwner(target)]
+	if len(tokens) == 0 {
+		return scopeAdmin
+	}
+	if token == "" {
+		return
+	}
+	hash := authHash(token)
+	for _, t := range tokens {
+		if t.Hash == hash {
+			return t.Scope
+		}
+	}
+
+	return
+}
+
+// Check that a request may access a target with the needed scope, replying
+// with an error if not
+func authCheck(httpRsp http.ResponseWriter, httpReq *http.Request, args map[string]string, target string, needed string) bool {
+
+	token := authPresented(httpReq, args)
+	if scopeRank[authScope(target, token)] >= scopeRank[needed] {
+		return true
+	}
+
+	if token == "" {
+		httpRsp.Header().Set("WWW-Authenticate", fmt.Sprintf("Bearer realm=%q", authOwner(target)))
+		http.Error(httpRsp, authOwner(target)+" requires a token", http.StatusUnauthorized)
+	} else {
+		http.Error(httpRsp, "token does not grant "+needed+" access to "+authOwner(target), http.StatusForbidden)
+	}
+	return false
+}
+
+// Check that a request may administer the service as a whole, which requires
+// the service's admin token if one is configured, replying with an error if not
+func authCheckService(httpRsp http.ResponseWriter, httpReq *http.Request, args map[string]string) bool {
+
+	if Config.AdminToken == "" {
+		return true
+	}
+	token := authPresented(httpReq, args)
+	if token != "" && subtle.ConstantTimeCompare([]byte(token), []byte(Config.AdminToken)) == 1 {
+		return true
+	}
+
+	if token == "" {
+		httpRsp.Header().Set("WWW-Authenticate", `Bearer realm="admin"`)
+		http.Error(httpRsp, "the admin token is required", http.StatusUnauthorized)
+	} else {
+		http.Error(httpRsp, "token is not the admin token", http.StatusForbidden)
+	}
+	return false
+}
+
+// Issue a token for a target, returning it along with how it is identified
+func authIssue(target string, scope string, name string) (token string, t authToken, err error) {
+
+	if scopeRank[scope] == 0 {
+		err = fmt.Errorf("unrecognized scope: %s", scope)
+		return
+	}
+
+	random := make([]byte, 24)
+	_, err = rand.Read(random)
+	if err != nil {
+		return
+	}
+	token = hex.EncodeToString(random)
+	t = authToken{Hash: authHash(token), Scope: scope, Name: name, Created: time.Now().UTC().Format(time.RFC3339)}
+	t.ID = t.Hash[:12]
+
+	authLock.Lock()
+	defer authLock.Unlock()
+	if len(authTokens[target]) == 0 && scope != scopeAdmin {
+		err = fmt.Errorf("the first token of a target must have %s scope", scopeAdmin)
+		return
+	}
+	authTokens[target] = append(authTokens[target], t)
+	err = authSave()
+
+	return
+}
+
+// List the tokens of a target, without their hashes
+func authList(target string) (tokens []authToken) {
+	authLock.Lock()
+	defer authLock.Unlock()
+	tokens = []authToken{}
+	for _, t := range authTokens[target] {
+		t.Hash = ""
+		tokens = append(tokens, t)
+	}
+	return
+}
+
+// Revoke a token of a target.  Revoking the last of its tokens opens the
+// target to all once again, but the last of its admin tokens may not be
+// revoked while others remain, lest it be left without an administrator.
+func authRevoke(target string, id string) (err error) {
+
+	authLock.Lock()
+	defer authLock.Unlock()
+
+	tokens := authTokens[target]
+	for i, t := range tokens {
+		if t.ID == id {
+			tokens = append(tokens[:i:i], tokens[i+1:]...)
+			admins := 0
+			for _, other := range tokens {
+				if other.Scope == scopeAdmin {
+					admins++
+				}
+			}
+			if admins == 0 && len(tokens) > 0 {
+				return fmt.Errorf("the last %s token of %s may only be revoked once its other tokens are", scopeAdmin, target)
+			}
+			if len(tokens) == 0 {
+				delete(authTokens, target)
+			} else {
+				authTokens[target] = tokens
+			}
+			return authSave()
+		}
+	}
+
+	return fmt.Errorf("token %s of %s: %w", id, target, os.ErrNotExist)
+}
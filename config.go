@@ -24,6 +24,25 @@ type ServiceConfig struct {
 
 	// Twilio Sendgrid API key
 	TwilioSendgridAPIKey string `json:"twilio_sendgrid_api_key,omitempty"`
+
+	// Storage backend for records and uploaded files, either "files" (the
+	// default, with daily files under the data directory) or "bolt"
+	Store string `json:"store,omitempty"`
+
+	// Retention policies by target, with "*" for all other targets
+	Retention map[string]RetentionPolicy `json:"retention,omitempty"`
+
+	// Token granting admin access to every target, whether or not claimed
+	AdminToken string `json:"admin_token,omitempty"`
+
+	// Limits on the rate of writes to targets
+	RateLimit RateLimitConfig `json:"rate_limit,omitempty"`
+
+	// HTTPS, with a static certificate or one obtained automatically
+	TLS TLSConfig `json:"tls,omitempty"`
+
+	// Seconds to wait, when shutting down, for work in progress to finish
+	ShutdownSeconds int `json:"shutdown_seconds,omitempty"`
 }
 
 // ConfigPath (here for golint)
@@ -5,12 +5,15 @@
 package main
 
 import (
+	"context"
 	"time"
 )
 
-// Event is our timeout-enabled event waiter abstraction
+// Event is our timeout-enabled event waiter abstraction.  An event has a
+// single waiter, whose timer is reused from one wait to the next.
 type Event struct {
-	eq chan struct{}
+	eq    chan struct{}
+	timer *time.Timer
 }
 
 // EventNew allocates a new semaphore, initially unsignalled
@@ -28,11 +31,45 @@ func (evt *Event) IsSignalled() bool {
 // Wait waits for the event until the specified timeout, and
 // returns true if acquired, and false if timeout
 func (evt *Event) Wait(timeout time.Duration) bool {
+	return evt.WaitContext(context.Background(), timeout)
+}
+
+// WaitContext waits for the event until the specified timeout or until the
+// context is done, and returns true if acquired, and false otherwise
+func (evt *Event) WaitContext(ctx context.Context, timeout time.Duration) bool {
+
+	if evt.timer == nil {
+		evt.timer = time.NewTimer(timeout)
+	} else {
+		evt.timer.Reset(timeout)
+	}
+
+	acquired := false
+	expired := false
 	select {
 	case <-evt.eq:
-		return true
-	case <-time.After(timeout):
-		return false
+		acquired = true
+	case <-evt.timer.C:
+		expired = true
+	case <-ctx.Done():
+	}
+
+	// Leave the timer stopped and drained, ready to be reset
+	if !expired && !evt.timer.Stop() {
+		select {
+		case <-evt.timer.C:
+		default:
+		}
+	}
+
+	return acquired
+}
+
+// Reset returns the event to its unsignalled state
+func (evt *Event) Reset() {
+	select {
+	case <-evt.eq:
+	default:
 	}
 }
 
@@ -0,0 +1,382 @@
+// Copyright 2020 Blues Inc.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+// Record filters, as supplied to tail and watch with ?where=
+//
+// A filter is an expression over the fields of a record's JSON payload, such as
+//
+//	body.temp>30&&device=="dev:123"
+//
+// Fields are named by dotted paths, in which numeric components index arrays.
+// A path may be compared using ==, !=, <, <=, > or >= with a number, a quoted
+// string, true, false or null, and a field that is absent compares as null.
+// A path on its own tests that the field is present and is not false, null,
+// zero or empty.  Tests may be combined with &&, || and !, and grouped with
+// parentheses.
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// A parsed filter expression
+type filter struct {
+	op    string
+	left  *filter
+	right *filter
+	path  []string
+	value interface{}
+}
+
+// Lexical tokens of a filter expression
+const (
+	filterTokEnd = iota
+	filterTokPath
+	filterTokValue
+	filterTokOp
+)
+
+type filterToken struct {
+	kind  int
+	text  string
+	value interface{}
+}
+
+// The state of a filter being parsed
+type filterParser struct {
+	tokens []filterToken
+	next   int
+}
+
+// Parse a filter expression, returning nil if the expression is empty
+func filterParse(expr string) (f *filter, err error) {
+
+	if strings.TrimSpace(expr) == "" {
+		return
+	}
+
+	p := filterParser{}
+	p.tokens, err = filterLex(expr)
+	if err != nil {
+		return
+	}
+
+	f, err = p.parseOr()
+	if err != nil {
+		return
+	}
+	if p.peek().kind != filterTokEnd {
+		err = fmt.Errorf("where: unexpected '%s'", p.peek().text)
+		f = nil
+	}
+
+	return
+}
+
+// Split a filter expression into tokens
+func filterLex(expr string) (tokens []filterToken, err error) {
+
+	i := 0
+	for i < len(expr) {
+		c := expr[i]
+		switch {
+
+		case c == ' ' || c == '\t':
+			i++
+
+		case c == '(' || c == ')':
+			tokens = append(tokens, filterToken{kind: filterTokOp, text: string(c)})
+			i++
+
+		case strings.HasPrefix(expr[i:], "&&") || strings.HasPrefix(expr[i:], "||") ||
+			strings.HasPrefix(expr[i:], "==") || strings.HasPrefix(expr[i:], "!=") ||
+			strings.HasPrefix(expr[i:], "<=") || strings.HasPrefix(expr[i:], ">="):
+			tokens = append(tokens, filterToken{kind: filterTokOp, text: expr[i : i+2]})
+			i += 2
+
+		case c == '<' || c == '>' || c == '!':
+			tokens = append(tokens, filterToken{kind: filterTokOp, text: string(c)})
+			i++
+
+		case c == '"' || c == '\'':
+			j := i + 1
+			for j < len(expr) && expr[j] != c {
+				if expr[j] == '\\' {
+					j++
+				}
+				j++
+			}
+			if j >= len(expr) {
+				err = fmt.Errorf("where: unterminated string")
+				return
+			}
+			s := expr[i+1 : j]
+			if c == '"' {
+				s, err = strconv.Unquote(expr[i : j+1])
+				if err != nil {
+					err = fmt.Errorf("where: bad string %s", expr[i:j+1])
+					return
+				}
+			}
+			tokens = append(tokens, filterToken{kind: filterTokValue, text: expr[i : j+1], value: s})
+			i = j + 1
+
+		case c == '-' || (c >= '0' && c <= '9'):
+			j := i + 1
+			for j < len(expr) && strings.IndexByte("0123456789.eE+-", expr[j]) >= 0 {
+				j++
+			}
+			var n float64
+			n, err = strconv.ParseFloat(expr[i:j], 64)
+			if err != nil {
+				err = fmt.Errorf("where: bad number %s", expr[i:j])
+				return
+			}
+			tokens = append(tokens, filterToken{kind: filterTokValue, text: expr[i:j], value: n})
+			i = j
+
+		case filterPathChar(c):
+			j := i + 1
+			for j < len(expr) && (filterPathChar(expr[j]) || (expr[j] >= '0' && expr[j] <= '9')) {
+				j++
+			}
+			word := expr[i:j]
+			switch word {
+			case "true":
+				tokens = append(tokens, filterToken{kind: filterTokValue, text: word, value: true})
+			case "false":
+				tokens = append(tokens, filterToken{kind: filterTokValue, text: word, value: false})
+			case "null":
+				tokens = append(tokens, filterToken{kind: filterTokValue, text: word, value: nil})
+			default:
+				tokens = append(tokens, filterToken{kind: filterTokPath, text: word})
+			}
+			i = j
+
+		default:
+			err = fmt.Errorf("where: unexpected '%c'", c)
+			return
+
+		}
+	}
+
+	tokens = append(tokens, filterToken{kind: filterTokEnd, text: "end of expression"})
+	return
+}
+
+// Characters that may begin a field path
+func filterPathChar(c byte) bool {
+	return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || c == '_' || c == '.' || c == '$'
+}
+
+// Peek at the next token
+func (p *filterParser) peek() filterToken {
+	return p.tokens[p.next]
+}
+
+// Consume the next token if it is the given operator
+func (p *filterParser) accept(op string) bool {
+	t := p.tokens[p.next]
+	if t.kind == filterTokOp && t.text == op {
+		p.next++
+		return true
+	}
+	return false
+}
+
+// or := and ('||' and)*
+func (p *filterParser) parseOr() (f *filter, err error) {
+	f, err = p.parseAnd()
+	for err == nil && p.accept("||") {
+		var right *filter
+		right, err = p.parseAnd()
+		f = &filter{op: "||", left: f, right: right}
+	}
+	return
+}
+
+// and := unary ('&&' unary)*
+func (p *filterParser) parseAnd() (f *filter, err error) {
+	f, err = p.parseUnary()
+	for err == nil && p.accept("&&") {
+		var right *filter
+		right, err = p.parseUnary()
+		f = &filter{op: "&&", left: f, right: right}
+	}
+	return
+}
+
+// unary := '!' unary | '(' or ')' | path [op value]
+func (p *filterParser) parseUnary() (f *filter, err error) {
+
+	if p.accept("!") {
+		var operand *filter
+		operand, err = p.parseUnary()
+		f = &filter{op: "!", left: operand}
+		return
+	}
+
+	if p.accept("(") {
+		f, err = p.parseOr()
+		if err == nil && !p.accept(")") {
+			err = fmt.Errorf("where: expected ')' but found '%s'", p.peek().text)
+		}
+		return
+	}
+
+	t := p.peek()
+	if t.kind != filterTokPath {
+		err = fmt.Errorf("where: expected a field but found '%s'", t.text)
+		return
+	}
+	p.next++
+	f = &filter{path: strings.Split(strings.Trim(t.text, "."), ".")}
+
+	t = p.peek()
+	switch t.text {
+	case "==", "!=", "<", "<=", ">", ">=":
+		if t.kind != filterTokOp {
+			break
+		}
+		p.next++
+		v := p.peek()
+		if v.kind != filterTokValue {
+			err = fmt.Errorf("where: expected a value after %s but found '%s'", t.text, v.text)
+			return
+		}
+		p.next++
+		f.op = t.text
+		f.value = v.value
+	}
+
+	return
+}
+
+// See if a record's JSON payload matches the filter.  A nil filter matches all.
+func (f *filter) match(payload []byte) bool {
+	if f == nil {
+		return true
+	}
+	var obj interface{}
+	err := json.Unmarshal(payload, &obj)
+	if err != nil {
+		return false
+	}
+	return f.matchObject(obj)
+}
+
+// See if an already-unmarshaled payload matches the filter
+func (f *filter) matchObject(obj interface{}) bool {
+	if f == nil {
+		return true
+	}
+	switch f.op {
+	case "&&":
+		return f.left.matchObject(obj) && f.right.matchObject(obj)
+	case "||":
+		return f.left.matchObject(obj) || f.right.matchObject(obj)
+	case "!":
+		return !f.left.matchObject(obj)
+	case "":
+		return filterTruthy(filterLookup(obj, f.path))
+	}
+	return filterCompare(filterLookup(obj, f.path), f.op, f.value)
+}
+
+// Look up a field by path, returning nil if it's not present
+func filterLookup(obj interface{}, path []string) interface{} {
+	for _, key := range path {
+		switch o := obj.(type) {
+		case map[string]interface{}:
+			obj = o[key]
+		case []interface{}:
+			i, err := strconv.Atoi(key)
+			if err != nil || i < 0 || i >= len(o) {
+				return nil
+			}
+			obj = o[i]
+		default:
+			return nil
+		}
+	}
+	return obj
+}
+
+// See if a field value should be considered true
+func filterTruthy(v interface{}) bool {
+	switch x := v.(type) {
+	case nil:
+		return false
+	case bool:
+		return x
+	case float64:
+		return x != 0
+	case string:
+		return x != ""
+	case []interface{}:
+		return len(x) != 0
+	case map[string]interface{}:
+		return len(x) != 0
+	}
+	return true
+}
+
+// Compare a field value with a value from the expression.  Values of different
+// types are never equal, and are never ordered.
+func filterCompare(a interface{}, op string, b interface{}) bool {
+	cmp := 0
+	switch x := a.(type) {
+	case float64:
+		y, ok := b.(float64)
+		if !ok {
+			return op == "!="
+		}
+		if x < y {
+			cmp = -1
+		} else if x > y {
+			cmp = 1
+		}
+	case string:
+		y, ok := b.(string)
+		if !ok {
+			return op == "!="
+		}
+		cmp = strings.Compare(x, y)
+	case bool:
+		y, ok := b.(bool)
+		if !ok || (op != "==" && op != "!=") {
+			return op == "!=" && !ok
+		}
+		if x != y {
+			cmp = 1
+		}
+	case nil:
+		if op != "==" && op != "!=" {
+			return false
+		}
+		if b != nil {
+			cmp = 1
+		}
+	default:
+		return op == "!="
+	}
+	switch op {
+	case "==":
+		return cmp == 0
+	case "!=":
+		return cmp != 0
+	case "<":
+		return cmp < 0
+	case "<=":
+		return cmp <= 0
+	case ">":
+		return cmp > 0
+	case ">=":
+		return cmp >= 0
+	}
+	return false
+}
@@ -0,0 +1,248 @@
+// Copyright 2020 Blues Inc.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+// Output formats for the records returned by tail and range queries
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Supported values of ?format=
+const (
+	formatDefault = ""
+	formatNDJSON  = "ndjson"
+	formatArray   = "array"
+	formatCSV     = "csv"
+)
+
+// How records are to be rendered for a client
+type outputFormat struct {
+
+	// One of the formats above
+	format string
+
+	// If specified with ?fields=, the dotted paths of the fields to project,
+	// which become the keys of each output object or the columns of a CSV
+	names  []string
+	fields [][]string
+
+	// Notehub-specific one-line summary of each record (?text=1), records
+	// wrapped in their envelope (?meta=1), and blank lines between records
+	// in the default format (?nl=1)
+	bodyText bool
+	meta     bool
+	newline  bool
+}
+
+// Parse the output format args
+func formatParse(args map[string]string) (of outputFormat, err error) {
+
+	of.format = strings.ToLower(args["format"])
+	switch of.format {
+	case formatDefault, formatNDJSON, formatArray, formatCSV:
+	default:
+		err = fmt.Errorf("unsupported format: %s", args["format"])
+		return
+	}
+
+	for _, name := range strings.Split(args["fields"], ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		of.names = append(of.names, name)
+		of.fields = append(of.fields, strings.Split(name, "."))
+	}
+
+	of.bodyText = args["text"] != ""
+	of.meta = args["meta"] != ""
+	of.newline = args["nl"] != ""
+
+	return
+}
+
+// The content type of rendered records
+func (of outputFormat) contentType() string {
+	switch of.format {
+	case formatNDJSON:
+		return "application/x-ndjson"
+	case formatArray:
+		return "application/json"
+	case formatCSV:
+		return "text/csv; charset=utf-8"
+	}
+	return ""
+}
+
+// Render records, oldest first
+func (of outputFormat) render(records []storedRecord) (data []byte) {
+
+	switch of.format {
+
+	case formatCSV:
+		return of.renderCSV(records)
+
+	case formatArray:
+		items := []json.RawMessage{}
+		for _, rec := range records {
+			items = append(items, of.recordJSON(rec))
+		}
+		data, _ = json.Marshal(items)
+		return append(data, []byte("\n")...)
+
+	case formatNDJSON:
+		for _, rec := range records {
+			data = append(data, of.recordLine(rec)...)
+			data = append(data, []byte("\n")...)
+		}
+		return
+
+	}
+
+	// By default, records are separated (but not terminated) by newlines
+	for i, rec := range records {
+		if i > 0 {
+			data = append(data, []byte("\n")...)
+			if of.newline {
+				data = append(data, []byte("\n")...)
+			}
+		}
+		data = append(data, of.recordLine(rec)...)
+	}
+	return
+
+}
+
+// Render a record as a single line of text
+func (of outputFormat) recordLine(rec storedRecord) []byte {
+	if of.bodyText {
+		return extractBodyText(rec.Payload)
+	}
+	return of.recordJSON(rec)
+}
+
+// Render a record as JSON, projected to the requested fields if any
+func (of outputFormat) recordJSON(rec storedRecord) json.RawMessage {
+
+	if len(of.fields) == 0 {
+		if of.meta {
+			recJSON, err := json.Marshal(rec)
+			if err == nil {
+				return recJSON
+			}
+		}
+		return rec.Payload
+	}
+
+	// Marshal the fields in the order requested, rather than in key order
+	obj := of.recordObject(rec)
+	var b bytes.Buffer
+	b.WriteString("{")
+	for i, path := range of.fields {
+		if i > 0 {
+			b.WriteString(",")
+		}
+		name, _ := json.Marshal(of.names[i])
+		value, err := json.Marshal(filterLookup(obj, path))
+		if err != nil {
+			value = []byte("null")
+		}
+		b.Write(name)
+		b.WriteString(":")
+		b.Write(value)
+	}
+	b.WriteString("}")
+	return b.Bytes()
+
+}
+
+// Unmarshal a record for field lookup, within its envelope if requested
+func (of outputFormat) recordObject(rec storedRecord) (obj interface{}) {
+	json.Unmarshal(rec.Payload, &obj)
+	if of.meta {
+		obj = map[string]interface{}{"seq": float64(rec.Seq), "received": rec.Received, "payload": obj}
+	}
+	return
+}
+
+// Render records as CSV, with a header row naming the columns.  Without an
+// explicit list of fields, every leaf field of every record becomes a column.
+func (of outputFormat) renderCSV(records []storedRecord) []byte {
+
+	objects := []interface{}{}
+	for _, rec := range records {
+		objects = append(objects, of.recordObject(rec))
+	}
+
+	names := of.names
+	fields := of.fields
+	if len(fields) == 0 {
+		columns := map[string]bool{}
+		for _, obj := range objects {
+			formatFlatten("", obj, columns)
+		}
+		for name := range columns {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			fields = append(fields, strings.Split(name, "."))
+		}
+	}
+
+	var b bytes.Buffer
+	w := csv.NewWriter(&b)
+	w.Write(names)
+	for _, obj := range objects {
+		row := make([]string, len(fields))
+		for i, path := range fields {
+			row[i] = formatCSVValue(filterLookup(obj, path))
+		}
+		w.Write(row)
+	}
+	w.Flush()
+
+	return b.Bytes()
+
+}
+
+// Gather the dotted paths of all leaf fields of an object
+func formatFlatten(prefix string, obj interface{}, paths map[string]bool) {
+	o, isObject := obj.(map[string]interface{})
+	if !isObject || len(o) == 0 {
+		if prefix != "" {
+			paths[prefix] = true
+		}
+		return
+	}
+	for key, value := range o {
+		if prefix != "" {
+			key = prefix + "." + key
+		}
+		formatFlatten(key, value, paths)
+	}
+}
+
+// Format a single field value as a CSV cell, with arrays and objects as JSON
+func formatCSVValue(v interface{}) string {
+	switch x := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return x
+	case bool:
+		return strconv.FormatBool(x)
+	case float64:
+		return strconv.FormatFloat(x, 'f', -1, 64)
+	}
+	valueJSON, _ := json.Marshal(v)
+	return string(valueJSON)
+}
@@ -10,7 +10,11 @@ require (
 	github.com/go-audio/audio v1.0.0
 	github.com/go-audio/wav v1.1.0
 	github.com/google/uuid v1.6.0
+	github.com/santhosh-tekuri/jsonschema/v5 v5.3.1
 	github.com/sendgrid/sendgrid-go v3.16.0+incompatible
+	go.etcd.io/bbolt v1.3.11
+	golang.org/x/crypto v0.8.0
+	golang.org/x/net v0.9.0
 )
 
 require (
@@ -27,8 +31,8 @@ require (
 	github.com/tklauser/numcpus v0.9.0 // indirect
 	github.com/yusufpapurcu/wmi v1.2.4 // indirect
 	go.bug.st/serial v1.6.2 // indirect
-	golang.org/x/net v0.8.0 // indirect
 	golang.org/x/sys v0.30.0 // indirect
+	golang.org/x/text v0.9.0 // indirect
 	periph.io/x/conn/v3 v3.7.2 // indirect
 	periph.io/x/host/v3 v3.8.3 // indirect
 )
@@ -10,7 +10,6 @@ import (
 	"fmt"
 	"io"
 	"net/http"
-	"os"
 )
 
 // Github webhook
@@ -37,7 +36,7 @@ func inboundWebGithubHandler(rw http.ResponseWriter, req *http.Request) {
 			p.Pusher.Name, p.HeadCommit.Commit.Committer.Name, p.HeadCommit.Commit.Message)
 	}
 
-	// Exit
-	os.Exit(0)
+	// Exit once this request, and any others in progress, have finished
+	go shutdown("of a push to GitHub")
 
 }
@@ -7,7 +7,6 @@ package main
 import (
 	"fmt"
 	"net/http"
-	"os"
 	"path/filepath"
 	"sort"
 	"strings"
@@ -24,7 +23,8 @@ var photoExtensions = map[string]bool{
 	".bmp":  true,
 }
 
-// Maximum number of retained photos per target directory.
+// Maximum number of retained photos per target directory, unless a
+// retention policy says otherwise.
 const configMaxPhotos = 10
 
 // How often the photo purge goroutine sweeps every photo directory.
@@ -39,24 +39,16 @@ type photoEntry struct {
 // listPhotosByMTime returns every image file in the target directory sorted
 // newest-first by modification time. Returns nil on any error.
 func listPhotosByMTime(target string) []photoEntry {
-	dir := filepath.Join(configDataDirectory, target)
-	entries, err := os.ReadDir(dir)
+	blobs, err := store.ListBlobs(target)
 	if err != nil {
 		return nil
 	}
 	var imgs []photoEntry
-	for _, e := range entries {
-		if e.IsDir() {
+	for _, b := range blobs {
+		if !photoExtensions[strings.ToLower(filepath.Ext(b.name))] {
 			continue
 		}
-		if !photoExtensions[strings.ToLower(filepath.Ext(e.Name()))] {
-			continue
-		}
-		info, err := e.Info()
-		if err != nil {
-			continue
-		}
-		imgs = append(imgs, photoEntry{e.Name(), info.ModTime()})
+		imgs = append(imgs, photoEntry{b.name, b.modTime})
 	}
 	sort.Slice(imgs, func(i, j int) bool {
 		return imgs[i].mod.After(imgs[j].mod)
@@ -67,16 +59,12 @@ func listPhotosByMTime(target string) []photoEntry {
 // isPhotoDirectory returns true if the target directory exists and contains
 // at least one file with a recognized image extension.
 func isPhotoDirectory(target string) bool {
-	dir := filepath.Join(configDataDirectory, target)
-	entries, err := os.ReadDir(dir)
+	blobs, err := store.ListBlobs(target)
 	if err != nil {
 		return false
 	}
-	for _, e := range entries {
-		if e.IsDir() {
-			continue
-		}
-		if photoExtensions[strings.ToLower(filepath.Ext(e.Name()))] {
+	for _, b := range blobs {
+		if photoExtensions[strings.ToLower(filepath.Ext(b.name))] {
 			return true
 		}
 	}
@@ -104,10 +92,8 @@ func purgePhotos(target string, keep int) {
 	if len(imgs) <= keep {
 		return
 	}
-	dir := filepath.Join(configDataDirectory, target)
 	for _, img := range imgs[keep:] {
-		path := filepath.Join(dir, img.name)
-		if err := os.Remove(path); err != nil {
+		if err := store.DeleteBlob(target + "/" + img.name); err != nil {
 			fmt.Printf("purge photo %s/%s: %s\n", target, img.name, err)
 		} else {
 			fmt.Printf("purged photo %s/%s\n", target, img.name)
@@ -116,7 +102,7 @@ func purgePhotos(target string, keep int) {
 }
 
 // purgePhotosLoop runs forever, periodically trimming every photo directory
-// under configDataDirectory down to the latest configMaxPhotos images.
+// in the store down to the latest MaxPhotos images of its retention policy.
 // It uses tailTargets() to discover subdirectories and isPhotoDirectory() to
 // skip JSON-only targets, so a single sweep handles "photos", "camnote", etc.
 func purgePhotosLoop() {
@@ -126,7 +112,15 @@ func purgePhotosLoop() {
 			if !isPhotoDirectory(target) {
 				continue
 			}
-			purgePhotos(target, configMaxPhotos)
+			policy := retentionPolicyFor(target)
+			keep := policy.MaxPhotos
+			if keep == 0 {
+				keep = configMaxPhotos
+			}
+			if policy.NeverPurge || keep < 0 {
+				continue
+			}
+			purgePhotos(target, keep)
 		}
 	}
 }
@@ -0,0 +1,35 @@
+// Copyright 2020 Blues Inc.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// The state of rate limiting, as reported by GET /.ratelimit
+type rateLimitStatus struct {
+	Limits  RateLimitConfig   `json:"limits"`
+	Buckets []rateBucketStats `json:"buckets"`
+}
+
+// Rate limit stats handler, reporting the configured limits and the buckets
+// that have been drawn from and not yet refilled
+func inboundWebRateLimitHandler(httpRsp http.ResponseWriter, httpReq *http.Request) {
+
+	_, args := HTTPArgs(httpReq, "/.ratelimit")
+	if !authCheckService(httpRsp, httpReq, args) {
+		return
+	}
+
+	rspJSON, err := json.MarshalIndent(rateLimitStatus{Limits: Config.RateLimit, Buckets: rateStats()}, "", "    ")
+	if err != nil {
+		http.Error(httpRsp, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	httpRsp.Header().Set("Content-Type", "application/json")
+	httpRsp.Write(rspJSON)
+
+}
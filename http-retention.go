@@ -0,0 +1,158 @@
+// Copyright 2020 Blues Inc.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// The state of retention, as reported by GET /.retention
+type retentionStatus struct {
+	Policies  map[string]RetentionPolicy `json:"policies"`
+	Overrides map[string]RetentionPolicy `json:"overrides,omitempty"`
+	LastPurge string                     `json:"last_purge,omitempty"`
+	Purged    []retentionReport          `json:"purged"`
+}
+
+// Retention admin handler.  GET /.retention reports the policy in effect for
+// each target along with what the most recent purge discarded, and POST
+// /.retention purges immediately, both requiring the service's admin token if
+// one is configured.  GET, PUT and DELETE of /.retention/<target> read,
+// replace and remove the policy for a target, where "*" is the policy for all
+// targets not otherwise configured.
+func inboundWebRetentionHandler(httpRsp http.ResponseWriter, httpReq *http.Request) {
+
+	rawTarget, args := HTTPArgs(httpReq, "/.retention")
+	rawTarget = strings.TrimSuffix(rawTarget, "/")
+	target := rawTarget
+	if target != retentionDefaultKey {
+		target = cleanTarget(rawTarget)
+	}
+
+	// Reading the policy of a target requires read access to it, and anything
+	// else admin access to it.  Reading or changing the default policy, other
+	// than reading it, and anything to do with all targets requires admin
+	// access to the service.
+	reading := httpReq.Method == "" || httpReq.Method == "GET"
+	if target == "" || target == retentionDefaultKey {
+		if (target == "" || !reading) && !authCheckService(httpRsp, httpReq, args) {
+			return
+		}
+	} else {
+		needed := scopeAdmin
+		if reading {
+			needed = scopeRead
+		}
+		if !authCheck(httpRsp, httpReq, args, target, needed) {
+			return
+		}
+	}
+
+	// Operations on all targets
+	if target == "" {
+		switch httpReq.Method {
+		case "", "GET":
+			retentionWriteJSON(httpRsp, retentionGetStatus(authPresented(httpReq, args)))
+		case "POST":
+			retentionPurgeAll()
+			retentionWriteJSON(httpRsp, retentionGetStatus(authPresented(httpReq, args)))
+		default:
+			http.Error(httpRsp, "only GET and POST methods are supported", http.StatusMethodNotAllowed)
+		}
+		return
+	}
+
+	// Operations on a single target
+	switch httpReq.Method {
+
+	case "", "GET":
+		retentionWriteJSON(httpRsp, retentionPolicyFor(target))
+
+	case "PUT", "POST":
+		var policy RetentionPolicy
+		decoder := json.NewDecoder(httpReq.Body)
+		decoder.DisallowUnknownFields()
+		err := decoder.Decode(&policy)
+		if err != nil {
+			http.Error(httpRsp, "invalid policy: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if policy.MaxRecords < 0 || policy.MaxAgeDays < 0 || policy.MaxBytes < 0 || policy.MaxPhotos < -1 {
+			http.Error(httpRsp, "invalid policy: limits other than max_photos of -1 may not be negative", http.StatusBadRequest)
+			return
+		}
+		err = retentionSet(target, &policy)
+		if err != nil {
+			http.Error(httpRsp, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		retentionWriteJSON(httpRsp, policy)
+
+	case "DELETE":
+		err := retentionSet(target, nil)
+		if err != nil {
+			http.Error(httpRsp, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		retentionWriteJSON(httpRsp, retentionPolicyFor(target))
+
+	default:
+		http.Error(httpRsp, "only GET, PUT and DELETE methods are supported", http.StatusMethodNotAllowed)
+
+	}
+
+}
+
+// Gather the policies in effect for the known targets and the last purge results
+func retentionGetStatus(token string) (status retentionStatus) {
+
+	// Targets that have been claimed are left out unless the token may read
+	// them, which the service's admin token may
+	readable := func(target string) bool {
+		return target == retentionDefaultKey || scopeRank[authScope(target, token)] >= scopeRank[scopeRead]
+	}
+
+	status.Policies = map[string]RetentionPolicy{}
+	status.Policies[retentionDefaultKey] = retentionPolicyFor(retentionDefaultKey)
+	for _, target := range tailTargets() {
+		if readable(target) {
+			status.Policies[target] = retentionPolicyFor(target)
+		}
+	}
+
+	retentionLock.Lock()
+	status.Overrides = map[string]RetentionPolicy{}
+	for target, policy := range retentionOverrides {
+		if readable(target) {
+			status.Overrides[target] = policy
+		}
+	}
+	if !retentionLastPurge.IsZero() {
+		status.LastPurge = retentionLastPurge.Format(time.RFC3339)
+	}
+	status.Purged = []retentionReport{}
+	for _, report := range retentionLastReports {
+		if readable(report.Target) {
+			status.Purged = append(status.Purged, report)
+		}
+	}
+	retentionLock.Unlock()
+
+	return
+}
+
+// Reply with a JSON value
+func retentionWriteJSON(httpRsp http.ResponseWriter, v interface{}) {
+	rspJSON, err := json.MarshalIndent(v, "", "    ")
+	if err != nil {
+		http.Error(httpRsp, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	httpRsp.Header().Set("Content-Type", "application/json")
+	httpRsp.Write(rspJSON)
+}
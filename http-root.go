@@ -5,20 +5,20 @@
 package main
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
-	"mime"
 	"net/http"
 	"os"
 	"path/filepath"
 	"strconv"
 	"strings"
-	"sync"
+	"syscall"
 )
 
-// Ensure file integrity
-var fileLock sync.RWMutex
-
 // Root handler
 func inboundWebRootHandler(httpRsp http.ResponseWriter, httpReq *http.Request) {
 
@@ -36,9 +36,29 @@ func inboundWebRootHandler(httpRsp http.ResponseWriter, httpReq *http.Request) {
 
 	// Get the target
 	rawTarget, args := HTTPArgs(httpReq, "")
+
+	// Filter expressions commonly end in a quoted string, which must not be
+	// stripped of its quotes as other args are
+	if where, present := httpReq.URL.Query()["where"]; present && len(where) == 1 {
+		args["where"] = where[0]
+	}
+
 	rawTarget = strings.TrimSuffix(rawTarget, "/")
 	target := cleanTarget(rawTarget)
 
+	// The stream of posts rejected by a target's schema may be read and
+	// watched just as the target itself, but not written
+	rejected := false
+	if strings.HasSuffix(rawTarget, rejectedSuffix) && !strings.Contains(strings.TrimSuffix(rawTarget, rejectedSuffix), "/") {
+		rejected = true
+		rawTarget = strings.TrimSuffix(rawTarget, rejectedSuffix)
+		target = rejectedTarget(cleanTarget(rawTarget))
+		if method != "GET" {
+			http.Error(httpRsp, "rejected posts may only be read", http.StatusMethodNotAllowed)
+			return
+		}
+	}
+
 	// Exit if just the favicon
 	if rawTarget == "favicon.ico" {
 		return
@@ -59,6 +79,39 @@ func inboundWebRootHandler(httpRsp http.ResponseWriter, httpReq *http.Request) {
 	}
 	deleteFilename := args["delete"]
 
+	// A file or folder addressed by its path belongs to the target named by
+	// the path's first component, whereas records, and files named in the
+	// query, are written to the target named by the whole path, from which
+	// any slashes have been cleaned away.  Access is checked against whichever
+	// target is actually read or written.
+	boundary, formUpload := uploadFormBoundary(httpReq)
+	formUpload = formUpload && method == "POST" && uploadFilename == ""
+	accessed := target
+	if !rejected && strings.Contains(rawTarget, "/") && uploadFilename == "" && deleteFilename == "" && clean == 0 &&
+		(method == "GET" || method == "HEAD" || method == "DELETE" || formUpload) {
+		accessed = rawTarget
+	}
+
+	// Record posts and form uploads may write many records or files, and so
+	// are charged against the rate limits once they have been counted
+	recordPost := (method == "POST" || method == "PUT") && uploadFilename == "" && deleteFilename == "" && !formUpload && len(reqJSON) > 0
+	charged := !recordPost && !formUpload
+
+	// Check that the caller may do what is asked of a claimed target, where
+	// anything but reading requires write access and is subject to rate limits
+	if target != "" {
+		needed := scopeRead
+		if (method != "GET" && method != "HEAD") || uploadFilename != "" || deleteFilename != "" || clean != 0 {
+			needed = scopeWrite
+		}
+		if !authCheck(httpRsp, httpReq, args, accessed, needed) {
+			return
+		}
+		if needed == scopeWrite && charged && !rateCheck(httpRsp, httpReq, args, accessed, 1) {
+			return
+		}
+	}
+
 	// Map the delete verb
 	if method == "DELETE" && strings.Contains(rawTarget, "/") && !strings.Contains(rawTarget, ":") {
 		httpRsp.Write(deleteFile(rawTarget))
@@ -66,17 +119,35 @@ func inboundWebRootHandler(httpRsp http.ResponseWriter, httpReq *http.Request) {
 	}
 
 	// Process appropriately
+	if formUpload && target != "" {
+		dir, bad := cleanPath(rawTarget)
+		if bad {
+			http.Error(httpRsp, "invalid folder: "+rawTarget, http.StatusBadRequest)
+			return
+		}
+		uploadForm(httpRsp, httpReq, args, dir, boundary, reqJSON)
+		return
+	}
+	if (method == "POST" || method == "PUT") && uploadFilename != "" && uploadSync(httpReq, args) {
+		uploadFileSync(httpRsp, target+"/"+uploadFilename, append, reqJSON)
+		return
+	}
 	if (method == "POST" || method == "PUT") && uploadFilename != "" {
 		if len(reqJSON) == 0 {
 			httpRsp.Write([]byte("error: zero-length file"))
 			return
 		}
+		if reservedFilename(uploadFilename) {
+			http.Error(httpRsp, "invalid filename", http.StatusBadRequest)
+			return
+		}
 		// Acknowledge the upload as quickly as possible and tear down the
 		// connection so the caller (e.g. a camera posting at ~1 fps) never
 		// waits on our local disk I/O. The request body has already been
 		// fully read into reqJSON, so we can safely hand the write off to
 		// a goroutine. Any write error is logged by uploadFile; the caller
-		// will not see it — that is the intentional trade-off.
+		// will not see it — that is the intentional trade-off, which a caller
+		// may opt out of with ?sync=1.  A shutdown waits for the write to finish.
 		body := []byte("ok\n")
 		httpRsp.Header().Set("Content-Type", "text/plain; charset=utf-8")
 		httpRsp.Header().Set("Content-Length", strconv.Itoa(len(body)))
@@ -86,7 +157,7 @@ func inboundWebRootHandler(httpRsp http.ResponseWriter, httpReq *http.Request) {
 		if f, ok := httpRsp.(http.Flusher); ok {
 			f.Flush()
 		}
-		go uploadFile(target+"/"+uploadFilename, append, reqJSON)
+		shutdownGo(func() { uploadFile(target+"/"+uploadFilename, append, reqJSON) })
 		return
 	}
 	if deleteFilename != "" {
@@ -94,26 +165,42 @@ func inboundWebRootHandler(httpRsp http.ResponseWriter, httpReq *http.Request) {
 		return
 	}
 
-	if method == "GET" && strings.Contains(rawTarget, "/") && !strings.Contains(rawTarget, ":") {
-		var ctype string
-		c := strings.Split(rawTarget, ".")
-		if len(c) > 1 {
-			ctype = mime.TypeByExtension("." + c[len(c)-1])
-			if ctype != "" {
-				httpRsp.Header().Set("Content-Type", ctype)
-				httpRsp.WriteHeader(http.StatusOK)
-			}
+	if method == "GET" && args["list"] != "" && target != "" && !rejected {
+		dir, bad := cleanPath(rawTarget)
+		if bad {
+			http.Error(httpRsp, "invalid folder: "+rawTarget, http.StatusBadRequest)
+			return
+		}
+		listFiles(httpRsp, httpReq, dir, args)
+		return
+	}
+
+	if method == "GET" && args["uploader"] != "" && target != "" && !rejected {
+		dir, bad := cleanPath(rawTarget)
+		if bad {
+			http.Error(httpRsp, "invalid folder: "+rawTarget, http.StatusBadRequest)
+			return
 		}
-		contents, _ := getFile(rawTarget, ctype)
-		httpRsp.Write(contents)
+		uploadPage(httpRsp, dir)
 		return
 	}
 
 	if method == "GET" {
+		c := strings.Split(rawTarget, "/")
+		if len(c) == 3 && c[1] == "record" {
+			getRecord(httpRsp, cleanTarget(c[0]), c[2])
+			return
+		}
+	}
+
+	if (method == "GET" || method == "HEAD") && strings.Contains(rawTarget, "/") && !strings.Contains(rawTarget, ":") {
+		serveFile(httpRsp, httpReq, rawTarget)
+		return
+	}
+
+	if method == "GET" && !rejected {
 		path := rawTarget + "/index.html"
-		ctype := mime.TypeByExtension(".html")
-		_, exists := getFile(path, ctype)
-		if exists {
+		if fileExists(path) {
 			fmt.Printf("redirect to %s\n", path)
 			http.Redirect(httpRsp, httpReq, path, http.StatusTemporaryRedirect)
 			return
@@ -125,7 +212,25 @@ func inboundWebRootHandler(httpRsp http.ResponseWriter, httpReq *http.Request) {
 		return
 	}
 
+	if method == "GET" && (args["start"] != "" || args["end"] != "" || args["cursor"] != "") {
+		rangeQuery(httpRsp, target, args)
+		return
+	}
+
 	if method == "GET" && count != 0 {
+		_, err = filterParse(args["where"])
+		if err != nil {
+			http.Error(httpRsp, err.Error(), http.StatusBadRequest)
+			return
+		}
+		of, err := formatParse(args)
+		if err != nil {
+			http.Error(httpRsp, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if of.contentType() != "" {
+			httpRsp.Header().Set("Content-Type", of.contentType())
+		}
 		data := tail(target, count, false, &args)
 		httpRsp.Write(data)
 		return
@@ -151,12 +256,12 @@ func inboundWebRootHandler(httpRsp http.ResponseWriter, httpReq *http.Request) {
 	}
 
 	if method == "GET" {
-		watch(httpRsp, httpReq, target)
+		watch(httpRsp, httpReq, target, args)
 		return
 	}
 
 	if (method == "POST" || method == "PUT") && len(reqJSON) > 0 {
-		post(httpRsp, target, reqJSON)
+		post(httpRsp, httpReq, target, reqJSON, args)
 		return
 	}
 
@@ -177,6 +282,22 @@ func cleanTarget(in string) (out string) {
 	return
 }
 
+// Clean the path of a folder or file within a target, cleaning its first
+// component as a target, as are the targets of all writes, so that the path
+// addresses a folder or file within the target to which it would be uploaded
+func cleanPath(in string) (out string, bad bool) {
+	c := strings.SplitN(in, "/", 2)
+	out = cleanTarget(c[0])
+	if len(c) > 1 && c[1] != "" {
+		out = out + "/" + c[1]
+	}
+	_, bad = cleanFilename(out)
+	if out == "" {
+		bad = true
+	}
+	return
+}
+
 // Clean a filename
 func cleanFilename(in string) (out string, bad bool) {
 	if strings.Contains(in, "..") {
@@ -192,54 +313,138 @@ func cleanFilename(in string) (out string, bad bool) {
 	return
 }
 
+// Determine whether a file's name is reserved for the service's own state,
+// such as a target's schema, its rejected posts and its uploads in progress,
+// which are all named with a leading dot and may only be read or written by
+// the service itself
+func reservedFilename(filename string) bool {
+	for _, c := range strings.Split(filename, "/") {
+		if strings.HasPrefix(c, ".") {
+			return true
+		}
+	}
+	return false
+}
+
 // Upload a file. This runs on a background goroutine so the HTTP caller
 // does not wait on local disk I/O; any error is logged here and not
 // propagated back to the client.
 func uploadFile(filename string, append bool, contents []byte) {
 
-	pathname, bad := cleanFilename(filename)
-	if bad {
+	_, bad := cleanFilename(filename)
+	if bad || reservedFilename(filename) {
+		fmt.Printf("  upload err %s: invalid filename\n", filename)
 		return
 	}
 
 	fmt.Printf("upload %d bytes to '%s'\n", len(contents), filename)
 
-	c := strings.Split(pathname, "/")
-	if len(c) > 1 {
-		fileLock.Lock()
-		os.MkdirAll(strings.Join(c[0:len(c)-1], "/"), 0777)
-		fileLock.Unlock()
+	err := store.PutBlob(filename, contents, append)
+	if err != nil {
+		fmt.Printf("  upload err %s: %s\n", filename, err)
 	}
+}
 
-	fileLock.Lock()
-	defer fileLock.Unlock()
+// The result of an upload whose caller waited for it to reach the disk
+type uploadResult struct {
+	File    string `json:"file"`
+	Written int    `json:"written"`
+	Size    int64  `json:"size"`
+	SHA256  string `json:"sha256"`
+}
 
-	flags := os.O_CREATE | os.O_WRONLY
-	if append {
-		flags = flags | os.O_APPEND
+// Determine whether the caller of an upload wants to wait until it is on
+// disk, and to be told whether it succeeded, rather than be acknowledged at
+// once.  This is asked for with ?sync=1 or an X-Upload-Sync: 1 header.
+func uploadSync(httpReq *http.Request, args map[string]string) bool {
+	for _, v := range []string{args["sync"], httpReq.Header.Get("X-Upload-Sync")} {
+		if v != "" && v != "0" && v != "false" {
+			return true
+		}
 	}
-	f, err := os.OpenFile(pathname, flags, 0644)
-	if err == nil {
-		_, err = f.Write(contents)
-		f.Close()
+	return false
+}
+
+// Upload a file, replying only once it has been written and flushed to disk,
+// with the size and SHA-256 checksum of the file as it now stands
+func uploadFileSync(httpRsp http.ResponseWriter, filename string, append bool, contents []byte) {
+
+	result, status, err := uploadStore(filename, append, contents)
+	if err != nil {
+		http.Error(httpRsp, err.Error(), status)
+		return
 	}
 
+	resultJSON, _ := json.Marshal(result)
+	httpRsp.Header().Set("Content-Type", "application/json")
+	httpRsp.Write(resultJSON)
+
+}
+
+// Write a file and flush it to disk, returning the size and checksum of the
+// file as it now stands or, if it couldn't be written, the status with which
+// to reply
+func uploadStore(filename string, append bool, contents []byte) (result uploadResult, status int, err error) {
+
+	status = http.StatusBadRequest
+	if len(contents) == 0 {
+		err = fmt.Errorf("zero-length file")
+		return
+	}
+	_, bad := cleanFilename(filename)
+	if bad || reservedFilename(filename) {
+		err = fmt.Errorf("invalid filename")
+		return
+	}
+
+	fmt.Printf("upload %d bytes to '%s' (sync)\n", len(contents), filename)
+
+	status = http.StatusInternalServerError
+	err = store.PutBlob(filename, contents, append)
+	if err == nil {
+		err = store.SyncBlob(filename)
+	}
 	if err != nil {
 		fmt.Printf("  upload err %s: %s\n", filename, err)
+		if errors.Is(err, syscall.ENOSPC) {
+			status = http.StatusInsufficientStorage
+		}
+		return
 	}
+
+	// The checksum is of the whole file, which when appending means reading
+	// it back, streamed so that a large file isn't held in memory
+	h := sha256.New()
+	size := int64(len(contents))
+	if !append {
+		h.Write(contents)
+	} else {
+		var r io.ReadSeekCloser
+		r, _, err = store.OpenBlob(filename)
+		if err != nil {
+			return
+		}
+		size, err = io.Copy(h, r)
+		r.Close()
+		if err != nil {
+			return
+		}
+	}
+	result = uploadResult{File: filename, Written: len(contents), Size: size, SHA256: hex.EncodeToString(h.Sum(nil))}
+	status = http.StatusOK
+
+	return
+
 }
 
 // Delete a file
 func deleteFile(filename string) (contents []byte) {
-	pathname, bad := cleanFilename(filename)
-	if bad {
-		return
+	_, bad := cleanFilename(filename)
+	if bad || reservedFilename(filename) {
+		return []byte("invalid filename")
 	}
 	fmt.Printf("FILE DELETE %s\n", filename)
-	var err error
-	fileLock.Lock()
-	err = os.Remove(pathname)
-	fileLock.Unlock()
+	err := store.DeleteBlob(filename)
 	if err != nil {
 		fmt.Printf("  err: %s\n", err)
 		contents = []byte(fmt.Sprintf("%s", err))
@@ -247,21 +452,43 @@ func deleteFile(filename string) (contents []byte) {
 	return
 }
 
-// Get a file
-func getFile(filename string, ctype string) (contents []byte, exists bool) {
-	pathname, bad := cleanFilename(filename)
+// Determine whether a file exists
+func fileExists(filename string) bool {
+	_, err := store.StatBlob(filename)
+	return err == nil
+}
+
+// Serve a file, streaming it rather than reading it whole.  Its validator is
+// derived from its size and modification time, which change whenever it is
+// written, so that clients may revalidate what they have cached and fetch
+// ranges of it, such as to resume a download or seek within audio.
+func serveFile(httpRsp http.ResponseWriter, httpReq *http.Request, filename string) {
+
+	// Files and folders whose names begin with a dot hold the service's own
+	// state, such as uploads in progress and schemas, and aren't served
+	if reservedFilename(filename) {
+		http.Error(httpRsp, "file not found", http.StatusNotFound)
+		return
+	}
+	_, bad := cleanFilename(filename)
 	if bad {
+		http.Error(httpRsp, "invalid filename", http.StatusBadRequest)
+		return
+	}
+
+	r, info, err := store.OpenBlob(filename)
+	if errors.Is(err, os.ErrNotExist) {
+		http.Error(httpRsp, "file not found", http.StatusNotFound)
 		return
 	}
-	var err error
-	fileLock.Lock()
-	contents, err = os.ReadFile(pathname)
-	fileLock.Unlock()
 	if err != nil {
-		contents = []byte(fmt.Sprintf("%s", err))
-	} else {
-		exists = true
-		fmt.Printf("FILE GET %s (%s)\n", filename, ctype)
+		http.Error(httpRsp, err.Error(), http.StatusInternalServerError)
+		return
 	}
-	return
+	defer r.Close()
+
+	fmt.Printf("FILE GET %s (%d bytes)\n", filename, info.size)
+	httpRsp.Header().Set("ETag", fmt.Sprintf("\"%x-%x\"", info.size, info.modTime.UnixNano()))
+	http.ServeContent(httpRsp, httpReq, info.name, info.modTime, r)
+
 }
@@ -0,0 +1,84 @@
+// Copyright 2020 Blues Inc.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// Schema admin handler.  GET /.schema/<target> returns the JSON Schema attached
+// to a target, PUT attaches one, and DELETE detaches it.  With ?quarantine=1
+// posts rejected by the schema are appended to <target>/.rejected, where they
+// may be tailed and watched.
+func inboundWebSchemaHandler(httpRsp http.ResponseWriter, httpReq *http.Request) {
+
+	rawTarget, args := HTTPArgs(httpReq, "/.schema")
+	target := cleanTarget(strings.TrimSuffix(rawTarget, "/"))
+	if target == "" {
+		http.Error(httpRsp, "target not specified", http.StatusBadRequest)
+		return
+	}
+	needed := scopeAdmin
+	if httpReq.Method == "" || httpReq.Method == "GET" {
+		needed = scopeRead
+	}
+	if !authCheck(httpRsp, httpReq, args, target, needed) {
+		return
+	}
+
+	switch httpReq.Method {
+
+	case "", "GET":
+		ts, err := schemaGet(target)
+		if errors.Is(err, os.ErrNotExist) {
+			http.Error(httpRsp, "no schema is attached to "+target, http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(httpRsp, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if ts.Quarantine {
+			httpRsp.Header().Set("X-Quarantine", "1")
+		}
+		httpRsp.Header().Set("Content-Type", "application/schema+json")
+		httpRsp.Write(ts.Schema)
+
+	case "PUT", "POST":
+		schemaJSON, err := io.ReadAll(httpReq.Body)
+		if err != nil {
+			http.Error(httpRsp, err.Error(), http.StatusBadRequest)
+			return
+		}
+		quarantine := args["quarantine"] != "" && args["quarantine"] != "0" && args["quarantine"] != "false"
+		err = schemaSet(target, schemaJSON, quarantine)
+		if err != nil {
+			http.Error(httpRsp, "invalid schema: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		httpRsp.Write([]byte("ok\n"))
+
+	case "DELETE":
+		err := schemaDelete(target)
+		if errors.Is(err, os.ErrNotExist) {
+			http.Error(httpRsp, "no schema is attached to "+target, http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(httpRsp, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		httpRsp.Write([]byte("ok\n"))
+
+	default:
+		http.Error(httpRsp, "only GET, PUT and DELETE methods are supported", http.StatusMethodNotAllowed)
+
+	}
+
+}
@@ -0,0 +1,82 @@
+// Copyright 2020 Blues Inc.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// The reply to the issuing of a token, the only time that the token is shown
+type tokenIssued struct {
+	Token string `json:"token"`
+	authToken
+}
+
+// Token admin handler.  GET /.tokens/<target> lists the tokens of a target,
+// POST /.tokens/<target>?scope=read|write|admin&name=<name> issues one, and
+// DELETE /.tokens/<target>/<id> revokes one.  All require admin access to the
+// target, which is granted to everyone until the target's first token, which
+// must be an admin token, has been issued.
+func inboundWebTokensHandler(httpRsp http.ResponseWriter, httpReq *http.Request) {
+
+	rawTarget, args := HTTPArgs(httpReq, "/.tokens")
+	c := strings.Split(strings.TrimSuffix(rawTarget, "/"), "/")
+	target := cleanTarget(c[0])
+	if target == "" || len(c) > 2 {
+		http.Error(httpRsp, "usage: /.tokens/<target>[/<id>]", http.StatusBadRequest)
+		return
+	}
+	if !authCheck(httpRsp, httpReq, args, target, scopeAdmin) {
+		return
+	}
+
+	switch httpReq.Method {
+
+	case "", "GET":
+		rspJSON, _ := json.MarshalIndent(authList(target), "", "    ")
+		httpRsp.Header().Set("Content-Type", "application/json")
+		httpRsp.Write(rspJSON)
+
+	case "POST", "PUT":
+		scope := args["scope"]
+		if scope == "" {
+			scope = scopeRead
+		}
+		token, t, err := authIssue(target, scope, args["name"])
+		if err != nil {
+			http.Error(httpRsp, err.Error(), http.StatusBadRequest)
+			return
+		}
+		t.Hash = ""
+		rspJSON, _ := json.MarshalIndent(tokenIssued{Token: token, authToken: t}, "", "    ")
+		httpRsp.Header().Set("Content-Type", "application/json")
+		httpRsp.Write(rspJSON)
+
+	case "DELETE":
+		if len(c) != 2 {
+			http.Error(httpRsp, "token id not specified", http.StatusBadRequest)
+			return
+		}
+		err := authRevoke(target, c[1])
+		if errors.Is(err, os.ErrNotExist) {
+			http.Error(httpRsp, err.Error(), http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(httpRsp, err.Error(), http.StatusConflict)
+			return
+		}
+		httpRsp.Write([]byte("ok\n"))
+
+	default:
+		http.Error(httpRsp, "only GET, POST and DELETE methods are supported", http.StatusMethodNotAllowed)
+
+	}
+
+}
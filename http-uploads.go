@@ -0,0 +1,177 @@
+// Copyright 2020 Blues Inc.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Resumable upload handler.
+//
+//	POST   /.uploads/<target>?file=<name>[&size=<bytes>]  begins an upload
+//	GET    /.uploads/<target>/<id>                        gets the committed offset
+//	PUT    /.uploads/<target>/<id>?offset=<bytes>         writes a chunk at that offset
+//	POST   /.uploads/<target>/<id>?sha256=<hex>           finishes the upload
+//	DELETE /.uploads/<target>/<id>                        abandons it
+//
+// The offset and checksum may instead be given in Upload-Offset and
+// Upload-SHA256 headers, and the committed offset is always returned in an
+// Upload-Offset header as well as in the reply.  A chunk at any offset but the
+// committed one is refused with 409, along with the committed offset.
+func inboundWebUploadsHandler(httpRsp http.ResponseWriter, httpReq *http.Request) {
+
+	rawTarget, args := HTTPArgs(httpReq, "/.uploads")
+	c := strings.Split(strings.TrimSuffix(rawTarget, "/"), "/")
+	target := cleanTarget(c[0])
+	if target == "" || len(c) > 2 {
+		http.Error(httpRsp, "usage: /.uploads/<target>[/<id>]", http.StatusBadRequest)
+		return
+	}
+	if !authCheck(httpRsp, httpReq, args, target, scopeWrite) {
+		return
+	}
+	id := ""
+	if len(c) == 2 {
+		id = c[1]
+	}
+
+	// Begin an upload
+	if id == "" {
+		if httpReq.Method != "POST" {
+			http.Error(httpRsp, "only POST is supported without an upload id", http.StatusMethodNotAllowed)
+			return
+		}
+		var size int64
+		if args["size"] != "" {
+			var err error
+			size, err = strconv.ParseInt(args["size"], 10, 64)
+			if err != nil {
+				http.Error(httpRsp, "invalid size: "+args["size"], http.StatusBadRequest)
+				return
+			}
+		}
+		session, err := uploadCreate(target, args["file"], size)
+		if err != nil {
+			http.Error(httpRsp, err.Error(), http.StatusBadRequest)
+			return
+		}
+		uploadReply(httpRsp, http.StatusCreated, session)
+		return
+	}
+
+	switch httpReq.Method {
+
+	case "", "GET", "HEAD":
+		session, err := uploadGet(target, id)
+		if err != nil {
+			uploadError(httpRsp, err, session)
+			return
+		}
+		uploadReply(httpRsp, http.StatusOK, session)
+
+	case "PUT", "PATCH":
+		offsetArg := args["offset"]
+		if offsetArg == "" {
+			offsetArg = httpReq.Header.Get("Upload-Offset")
+		}
+		offset, err := strconv.ParseInt(offsetArg, 10, 64)
+		if err != nil {
+			http.Error(httpRsp, "offset not specified", http.StatusBadRequest)
+			return
+		}
+		if !rateCheck(httpRsp, httpReq, args, target, 1) {
+			return
+		}
+		chunk, err := io.ReadAll(httpReq.Body)
+		if err != nil {
+			http.Error(httpRsp, err.Error(), http.StatusBadRequest)
+			return
+		}
+		session, err := uploadChunk(target, id, offset, chunk)
+		if err != nil {
+			uploadError(httpRsp, err, session)
+			return
+		}
+		uploadReply(httpRsp, http.StatusOK, session)
+
+	case "POST":
+		checksum := args["sha256"]
+		if checksum == "" {
+			checksum = httpReq.Header.Get("Upload-SHA256")
+		}
+		if checksum == "" {
+			http.Error(httpRsp, "sha256 not specified", http.StatusBadRequest)
+			return
+		}
+		result, err := uploadFinish(target, id, checksum)
+		if err != nil {
+			session, _ := uploadGet(target, id)
+			uploadError(httpRsp, err, session)
+			return
+		}
+		resultJSON, _ := json.Marshal(result)
+		httpRsp.Header().Set("Content-Type", "application/json")
+		httpRsp.Write(resultJSON)
+
+	case "DELETE":
+		err := uploadAbort(target, id)
+		if err != nil {
+			uploadError(httpRsp, err, uploadSession{})
+			return
+		}
+		httpRsp.Write([]byte("ok\n"))
+
+	default:
+		http.Error(httpRsp, "only GET, PUT, POST and DELETE methods are supported", http.StatusMethodNotAllowed)
+
+	}
+
+}
+
+// The state of an upload, along with why a request to it failed, if it did
+type uploadStatus struct {
+	uploadSession
+	Error string `json:"error,omitempty"`
+}
+
+// Reply with the state of an upload
+func uploadReply(httpRsp http.ResponseWriter, status int, session uploadSession) {
+	uploadReplyError(httpRsp, status, session, nil)
+}
+
+// Reply with the state of an upload and the error that befell a request to it
+func uploadReplyError(httpRsp http.ResponseWriter, status int, session uploadSession, err error) {
+	rsp := uploadStatus{uploadSession: session}
+	if err != nil {
+		rsp.Error = err.Error()
+	}
+	sessionJSON, _ := json.Marshal(rsp)
+	httpRsp.Header().Set("Content-Type", "application/json")
+	httpRsp.Header().Set("Upload-Offset", strconv.FormatInt(session.Offset, 10))
+	httpRsp.WriteHeader(status)
+	httpRsp.Write(sessionJSON)
+}
+
+// Reply with an error, along with the state of the upload if the client may
+// use it to carry on
+func uploadError(httpRsp http.ResponseWriter, err error, session uploadSession) {
+	switch {
+	case errors.Is(err, errUploadNotFound):
+		http.Error(httpRsp, err.Error(), http.StatusNotFound)
+	case errors.Is(err, errUploadOffset), errors.Is(err, errUploadIncomplete):
+		uploadReplyError(httpRsp, http.StatusConflict, session, err)
+	case errors.Is(err, errUploadTooLarge):
+		uploadReplyError(httpRsp, http.StatusRequestEntityTooLarge, session, err)
+	case errors.Is(err, errUploadChecksum):
+		uploadReplyError(httpRsp, http.StatusUnprocessableEntity, session, err)
+	default:
+		http.Error(httpRsp, err.Error(), http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,88 @@
+// Copyright 2020 Blues Inc.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Maximum number of targets and patterns in a single watch
+const configMaxWatchTargets = 100
+
+// Multi-target watch handler.  GET /watch?targets=a,b,site1-* watches the
+// named targets along with all targets whose names match a pattern, in which
+// * matches any run of characters and ? any one.  Each event is delivered in
+// its envelope, tagged with the target to which it was posted.  Without
+// ?targets= this is just the watch of a target named "watch".
+func inboundWebWatchHandler(httpRsp http.ResponseWriter, httpReq *http.Request) {
+
+	_, args := HTTPArgs(httpReq, "/watch")
+	if args["targets"] == "" || (httpReq.Method != "" && httpReq.Method != "GET") {
+		inboundWebRootHandler(httpRsp, httpReq)
+		return
+	}
+	if where, present := httpReq.URL.Query()["where"]; present && len(where) == 1 {
+		args["where"] = where[0]
+	}
+
+	opts, err := watchParseOptions(httpReq, args)
+	if err != nil {
+		http.Error(httpRsp, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Sort the targets from the patterns, checking that the client may read
+	// the targets it names.  Targets matching a pattern that the client may not
+	// read are skipped as their records arrive.
+	for _, target := range strings.Split(args["targets"], ",") {
+		target = strings.TrimSpace(target)
+		if target == "" {
+			continue
+		}
+		if watchIsPattern(target) {
+			opts.patterns = append(opts.patterns, watchCleanPattern(target))
+			continue
+		}
+		target = watchCleanTarget(target)
+		if !authCheck(httpRsp, httpReq, args, target, scopeRead) {
+			return
+		}
+		opts.targets = append(opts.targets, target)
+	}
+	if len(opts.targets)+len(opts.patterns) > configMaxWatchTargets {
+		http.Error(httpRsp, fmt.Sprintf("too many targets (%d maximum)", configMaxWatchTargets), http.StatusBadRequest)
+		return
+	}
+	if opts.multi() && opts.fromSeq > 0 {
+		http.Error(httpRsp, "sequence numbers are those of a single target, so use since to resume a watch of several", http.StatusBadRequest)
+		return
+	}
+
+	watchStart(httpRsp, httpReq, opts)
+
+}
+
+// Clean a target named in a watch, which may be the stream of posts rejected
+// by a target's schema
+func watchCleanTarget(target string) string {
+	if strings.HasSuffix(target, rejectedSuffix) {
+		return rejectedTarget(cleanTarget(strings.TrimSuffix(target, rejectedSuffix)))
+	}
+	return cleanTarget(target)
+}
+
+// Clean a target pattern in the same way as a target, but keeping its wildcards
+func watchCleanPattern(pattern string) (out string) {
+	for _, r := range pattern {
+		if r == '*' || r == '?' {
+			out = out + string(r)
+		} else {
+			out = out + cleanTarget(string(r))
+		}
+	}
+	return
+}
@@ -0,0 +1,48 @@
+// Copyright 2020 Blues Inc.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// The live watchers, as reported by GET /.watchers
+type watchersStatus struct {
+	Total    int            `json:"total"`
+	Targets  map[string]int `json:"targets"`
+	Patterns map[string]int `json:"patterns,omitempty"`
+}
+
+// Watchers handler, reporting the number of live watchers of each target and
+// of each target pattern, or with ?target= of just that target
+func inboundWebWatchersHandler(httpRsp http.ResponseWriter, httpReq *http.Request) {
+
+	_, args := HTTPArgs(httpReq, "/.watchers")
+
+	var status watchersStatus
+	status.Total, status.Targets, status.Patterns = watcherCounts()
+
+	// A single target may be asked about by anyone who may read it, but the
+	// whole list only by the service's administrator
+	if args["target"] != "" {
+		target := watchCleanTarget(args["target"])
+		if !authCheck(httpRsp, httpReq, args, target, scopeRead) {
+			return
+		}
+		status = watchersStatus{Total: status.Targets[target], Targets: map[string]int{target: status.Targets[target]}}
+	} else if !authCheckService(httpRsp, httpReq, args) {
+		return
+	}
+
+	rspJSON, err := json.MarshalIndent(status, "", "    ")
+	if err != nil {
+		http.Error(httpRsp, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	httpRsp.Header().Set("Content-Type", "application/json")
+	httpRsp.Write(rspJSON)
+
+}
@@ -6,9 +6,12 @@
 package main
 
 import (
+	"context"
 	"fmt"
+	"net"
 	"net/http"
 	"net/url"
+	"os"
 	"strings"
 )
 
@@ -28,11 +31,38 @@ func HTTPInboundHandler(port string) {
 	http.HandleFunc("/robots.txt", inboundWebPingHandler)
 	http.HandleFunc("/env", inboundWebEnvHandler)
 	http.HandleFunc("/lorawan", inboundWebLoRaWANHandler)
+	http.HandleFunc("/watch", inboundWebWatchHandler)
+
+	// Administration, under names beginning with a dot, which no target's name
+	// can, so that these never take the place of a target's own URL
+	http.HandleFunc("/.retention", inboundWebRetentionHandler)
+	http.HandleFunc("/.retention/", inboundWebRetentionHandler)
+	http.HandleFunc("/.schema/", inboundWebSchemaHandler)
+	http.HandleFunc("/.tokens/", inboundWebTokensHandler)
+	http.HandleFunc("/.ratelimit", inboundWebRateLimitHandler)
+	http.HandleFunc("/.watchers", inboundWebWatchersHandler)
+	http.HandleFunc("/.uploads/", inboundWebUploadsHandler)
+
+	// Targets
 	http.HandleFunc("/", inboundWebRootHandler)
 
+	// HTTPS, if configured, which determines how plain HTTP is handled
+	handler, err := tlsStart(http.DefaultServeMux)
+	if err != nil {
+		fmt.Printf("%s\n", err)
+		os.Exit(-1)
+	}
+
 	// HTTP
 	fmt.Printf("Now handling inbound HTTP on %s\n", port)
-	go http.ListenAndServe(port, nil)
+	server := &http.Server{Addr: port, Handler: handler, BaseContext: func(net.Listener) context.Context { return shutdownContext }}
+	shutdownRegister(server)
+	go func() {
+		err := server.ListenAndServe()
+		if err != nil && err != http.ErrServerClosed {
+			fmt.Printf("http: %s\n", err)
+		}
+	}()
 
 }
 
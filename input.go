@@ -68,7 +68,7 @@ func inputHandler() {
 		case "":
 
 		case "q":
-			os.Exit(0)
+			shutdown("of a console request")
 
 		default:
 			fmt.Printf("Unrecognized: '%s'\n", message)
@@ -91,10 +91,9 @@ func signalHandler() {
 	for {
 		switch <-ch {
 		case syscall.SIGINT:
-			fmt.Printf("*** Exiting because of SIGNAL \n")
-			os.Exit(0)
+			go shutdown("of SIGINT")
 		case syscall.SIGTERM:
-			return
+			go shutdown("of SIGTERM")
 		}
 	}
 }
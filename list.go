@@ -0,0 +1,126 @@
+// Copyright 2020 Blues Inc.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+// Listing of the files uploaded to a target, as JSON for programs or as an
+// index page for people
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// An entry of a listing, which is either a file or, in a listing that isn't
+// recursive, a folder, whose name ends with a slash
+type listEntry struct {
+	Name        string `json:"name"`
+	Dir         bool   `json:"dir,omitempty"`
+	Size        int64  `json:"size,omitempty"`
+	Modified    string `json:"mtime,omitempty"`
+	ContentType string `json:"content_type,omitempty"`
+}
+
+// List the files within a folder of a target, whose path has been cleaned,
+// which is the target itself if no folder is given.  With ?recursive=1 the
+// files in all the folders beneath it are listed, by their paths relative to
+// it; otherwise its folders are listed as entries of their own.  Files and
+// folders whose names begin with a dot hold the service's own state, such as
+// uploads in progress, and are left out.  The listing is an index page if
+// ?list=html or if a browser asks for HTML, and otherwise JSON.
+func listFiles(httpRsp http.ResponseWriter, httpReq *http.Request, dir string, args map[string]string) {
+
+	recursive := args["recursive"] != "" && args["recursive"] != "0"
+
+	blobs, err := store.ListBlobTree(dir)
+	if errors.Is(err, os.ErrNotExist) {
+		http.Error(httpRsp, "folder not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(httpRsp, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	entries := []listEntry{}
+	dirs := map[string]bool{}
+	for _, blob := range blobs {
+		hidden := false
+		for _, c := range strings.Split(blob.name, "/") {
+			if strings.HasPrefix(c, ".") {
+				hidden = true
+			}
+		}
+		if hidden {
+			continue
+		}
+		if !recursive && strings.Contains(blob.name, "/") {
+			sub := blob.name[:strings.Index(blob.name, "/")+1]
+			if !dirs[sub] {
+				dirs[sub] = true
+				entries = append(entries, listEntry{Name: sub, Dir: true})
+			}
+			continue
+		}
+		entry := listEntry{Name: blob.name, Size: blob.size, ContentType: mime.TypeByExtension(path.Ext(blob.name))}
+		if !blob.modTime.IsZero() {
+			entry.Modified = blob.modTime.UTC().Format(time.RFC3339)
+		}
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Name < entries[j].Name
+	})
+
+	asHTML := args["list"] == "html" || (args["list"] != "json" && strings.Contains(httpReq.Header.Get("Accept"), "text/html"))
+	if !asHTML {
+		entriesJSON, _ := json.MarshalIndent(entries, "", "    ")
+		httpRsp.Header().Set("Content-Type", "application/json")
+		httpRsp.Write(entriesJSON)
+		return
+	}
+
+	httpRsp.Header().Set("Content-Type", "text/html; charset=utf-8")
+	httpRsp.Write(listPage(dir, entries, recursive))
+
+}
+
+// Format a listing as an index page, linking to each file and, in a listing
+// that isn't recursive, to the listing of each folder and of its parent
+func listPage(dir string, entries []listEntry, recursive bool) []byte {
+
+	link := func(p string) string {
+		return (&url.URL{Path: "/" + p}).String()
+	}
+
+	var b bytes.Buffer
+	title := html.EscapeString("/" + dir + "/")
+	fmt.Fprintf(&b, "<!DOCTYPE html>\n<html><head><meta charset=\"utf-8\"><title>%s</title></head><body>\n", title)
+	fmt.Fprintf(&b, "<h1>%s</h1>\n<table>\n<tr><th align=\"left\">Name</th><th align=\"right\">Size</th><th align=\"left\">Modified</th></tr>\n", title)
+	if !recursive && strings.Contains(dir, "/") {
+		fmt.Fprintf(&b, "<tr><td><a href=\"%s/?list=html\">../</a></td><td></td><td></td></tr>\n", html.EscapeString(link(path.Dir(dir))))
+	}
+	for _, entry := range entries {
+		if entry.Dir {
+			fmt.Fprintf(&b, "<tr><td><a href=\"%s/?list=html\">%s</a></td><td></td><td></td></tr>\n",
+				html.EscapeString(link(dir+"/"+strings.TrimSuffix(entry.Name, "/"))), html.EscapeString(entry.Name))
+			continue
+		}
+		fmt.Fprintf(&b, "<tr><td><a href=\"%s\">%s</a></td><td align=\"right\">%d</td><td>%s</td></tr>\n",
+			html.EscapeString(link(dir+"/"+entry.Name)), html.EscapeString(entry.Name), entry.Size, html.EscapeString(entry.Modified))
+	}
+	b.WriteString("</table>\n</body></html>\n")
+
+	return b.Bytes()
+}
@@ -0,0 +1,95 @@
+// Copyright 2020 Blues Inc.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// Listing a folder gives the same results whichever store holds it, including
+// for folders that don't exist and targets that have records but no files
+func TestListFiles(t *testing.T) {
+
+	stores := map[string]func(t *testing.T) Store{
+		"files": func(t *testing.T) Store {
+			return &fileStore{dir: t.TempDir() + "/"}
+		},
+		"bolt": func(t *testing.T) Store {
+			s, err := boltStoreOpen(t.TempDir() + "/store.db")
+			if err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(func() { s.Close() })
+			return s
+		},
+	}
+
+	for name, open := range stores {
+		t.Run(name, func(t *testing.T) {
+
+			saved := store
+			store = open(t)
+			defer func() { store = saved }()
+			defer testQuiet()()
+
+			store.PutBlob("lt/a.txt", []byte("a"), false)
+			store.PutBlob("lt/sub/b.txt", []byte("bb"), false)
+			store.PutBlob("lt/.uploads/x", []byte("x"), false)
+			store.AppendRecord("rec", "2020-01-01", storedRecord{Seq: 1, Received: "2020-01-01T00:00:00.000Z", Payload: json.RawMessage(`{}`)})
+
+			cases := []struct {
+				dir    string
+				args   map[string]string
+				status int
+				names  []string
+			}{
+				{"lt", map[string]string{"list": "json"}, http.StatusOK, []string{"a.txt", "sub/"}},
+				{"lt", map[string]string{"list": "json", "recursive": "1"}, http.StatusOK, []string{"a.txt", "sub/b.txt"}},
+				{"lt/sub", map[string]string{"list": "json"}, http.StatusOK, []string{"b.txt"}},
+				{"lt/missing", map[string]string{"list": "json"}, http.StatusNotFound, nil},
+				{"missing", map[string]string{"list": "json"}, http.StatusNotFound, nil},
+				{"rec", map[string]string{"list": "json"}, http.StatusNotFound, nil},
+				{"lt/a.txt", map[string]string{"list": "json"}, http.StatusNotFound, nil},
+			}
+
+			for _, c := range cases {
+				rsp := httptest.NewRecorder()
+				listFiles(rsp, httptest.NewRequest("GET", "/"+c.dir+"/", nil), c.dir, c.args)
+				if rsp.Code != c.status {
+					t.Errorf("%s %v: status %d, want %d", c.dir, c.args, rsp.Code, c.status)
+					continue
+				}
+				if c.status != http.StatusOK {
+					continue
+				}
+				var entries []listEntry
+				err := json.Unmarshal(rsp.Body.Bytes(), &entries)
+				if err != nil {
+					t.Errorf("%s %v: %s", c.dir, c.args, err)
+					continue
+				}
+				names := []string{}
+				for _, entry := range entries {
+					names = append(names, entry.Name)
+				}
+				if len(names) != len(c.names) {
+					t.Errorf("%s %v: listed %v, want %v", c.dir, c.args, names, c.names)
+					continue
+				}
+				for i := range names {
+					if names[i] != c.names[i] {
+						t.Errorf("%s %v: listed %v, want %v", c.dir, c.args, names, c.names)
+						break
+					}
+				}
+			}
+
+		})
+	}
+
+}
@@ -17,7 +17,7 @@ const configDataDirectoryBase = "/data/"
 
 var configDataDirectory = ""
 
-// Maximum number of retained posts per target
+// Maximum number of retained posts per target, unless a retention policy says otherwise
 const configMaxPosts = 1000
 
 // Main service entry point
@@ -29,20 +29,27 @@ func main() {
 	// Compute folder location
 	configDataDirectory = os.Getenv("HOME") + configDataDirectoryBase
 
+	// Open the storage backend, and load the retention policies and tokens kept there
+	storeOpen()
+	retentionLoad()
+	authLoad()
+
 	// Spawn the console input handler
 	go inputHandler()
 
 	// Init our web request inbound server
 	go HTTPInboundHandler(":80")
 
-	// Periodically trim photo directories down to the latest configMaxPhotos
+	// Periodically trim photo directories down to the latest photos allowed
 	go purgePhotosLoop()
 
-	// Purge hourly
+	// Purge hourly, according to each target's retention policy, and then
+	// compact what is retained
 	for {
-		targets := tailTargets()
-		for _, target := range targets {
-			tail(target, configMaxPosts, true, nil)
+		retentionPurgeAll()
+		uploadPurgeIdle()
+		for _, target := range recordTargets() {
+			store.CompactRecords(target)
 		}
 		time.Sleep(60 * time.Minute)
 	}
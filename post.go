@@ -5,64 +5,200 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
 	"net/http"
-	"os"
-	"path/filepath"
-	"time"
+	"strings"
 )
 
-// Post to a target
-func post(httpRsp http.ResponseWriter, target string, payload []byte) {
+// Maximum number of items in a single batch post
+const configMaxBatchItems = 10000
 
-	// Ensure that it's JSON, and unmarshal it both to normal and indented forms
-	var payloadObject map[string]interface{}
-	err := json.Unmarshal(payload, &payloadObject)
-	if err != nil {
-		http.Error(httpRsp, err.Error(), http.StatusInternalServerError)
-		return
+// The field under which a value that isn't an object is stored, when wrapping
+// of such values is requested with ?wrap=1
+const postWrapField = "value"
+
+// The reply to a post, identifying the stored record
+type postResult struct {
+	Seq      int64  `json:"seq"`
+	Received string `json:"received"`
+}
+
+// The reply to a post that was rejected by the schema of its target
+type postRejection struct {
+	Error       string        `json:"error"`
+	Errors      []schemaError `json:"errors"`
+	Quarantined bool          `json:"quarantined,omitempty"`
+}
+
+// The outcome of posting one item of a batch
+type postItemResult struct {
+	Index       int           `json:"index"`
+	Seq         int64         `json:"seq,omitempty"`
+	Received    string        `json:"received,omitempty"`
+	Error       string        `json:"error,omitempty"`
+	Errors      []schemaError `json:"errors,omitempty"`
+	Quarantined bool          `json:"quarantined,omitempty"`
+}
+
+// The reply to a batch post, summarizing the outcome of each item
+type postBatchResult struct {
+	Accepted int              `json:"accepted"`
+	Rejected int              `json:"rejected"`
+	Results  []postItemResult `json:"results"`
+}
+
+// Post to a target.  The body is either a single JSON object, a JSON array of
+// items, or newline-delimited JSON items if so labeled by its content type or
+// by ?ndjson=1.  Each item of a batch is stored as a record of its own.  Items
+// must be objects unless ?wrap= is given, in which case other values are
+// stored within an object under the field it names, or "value" if ?wrap=1.
+// The request is charged against the rate limits for each item.
+func post(httpRsp http.ResponseWriter, httpReq *http.Request, target string, payload []byte, args map[string]string) {
+
+	contentType := httpReq.Header.Get("Content-Type")
+
+	wrap := args["wrap"]
+	if wrap == "1" || wrap == "true" {
+		wrap = postWrapField
 	}
-	payloadJSON, err := json.Marshal(payloadObject)
-	if err != nil {
-		http.Error(httpRsp, err.Error(), http.StatusInternalServerError)
+
+	// Split a batch into its items
+	var items []json.RawMessage
+	batch := false
+	if strings.Contains(contentType, "ndjson") || strings.Contains(contentType, "jsonl") || args["ndjson"] != "" {
+		batch = true
+		for _, line := range bytes.Split(payload, []byte("\n")) {
+			line = bytes.TrimSpace(line)
+			if len(line) > 0 {
+				items = append(items, json.RawMessage(line))
+			}
+		}
+	} else if trimmed := bytes.TrimSpace(payload); len(trimmed) > 0 && trimmed[0] == '[' {
+		batch = true
+		err := json.Unmarshal(trimmed, &items)
+		if err != nil {
+			http.Error(httpRsp, err.Error(), http.StatusBadRequest)
+			return
+		}
+	} else {
+		items = []json.RawMessage{payload}
+	}
+	if len(items) > configMaxBatchItems {
+		http.Error(httpRsp, fmt.Sprintf("too many items in batch (%d maximum)", configMaxBatchItems), http.StatusRequestEntityTooLarge)
 		return
 	}
-	payloadJSON = append(payloadJSON, []byte("\n")...)
-	payloadJSONIndented, err := json.MarshalIndent(payloadObject, "", "    ")
-	if err != nil {
-		http.Error(httpRsp, err.Error(), http.StatusInternalServerError)
+	if !rateCheck(httpRsp, httpReq, args, target, len(items)) {
 		return
 	}
 
 	// Show that we're posting
-	fmt.Printf("post %s\n", target)
+	if batch {
+		fmt.Printf("post %s (%d items)\n", target, len(items))
+	} else {
+		fmt.Printf("post %s\n", target)
+	}
+
+	// Post each item in turn
+	var resultJSON []byte
+	status := http.StatusOK
+	if batch {
+		result := postBatchResult{Results: []postItemResult{}}
+		for i, item := range items {
+			itemResult, _ := postItem(target, item, wrap)
+			itemResult.Index = i
+			if itemResult.Error == "" {
+				result.Accepted++
+			} else {
+				result.Rejected++
+			}
+			result.Results = append(result.Results, itemResult)
+		}
+		if result.Accepted == 0 && result.Rejected > 0 {
+			status = http.StatusUnprocessableEntity
+		}
+		resultJSON, _ = json.Marshal(result)
+	} else {
+
+		// Reply to a single item as always, with the sequence number and
+		// receive time by which the record may later be found
+		itemResult, itemStatus := postItem(target, items[0], wrap)
+		if itemStatus == http.StatusUnprocessableEntity {
+			status = itemStatus
+			resultJSON, _ = json.Marshal(postRejection{Error: itemResult.Error, Errors: itemResult.Errors, Quarantined: itemResult.Quarantined})
+		} else if itemStatus != http.StatusOK {
+			http.Error(httpRsp, itemResult.Error, itemStatus)
+			return
+		} else {
+			resultJSON, _ = json.Marshal(postResult{Seq: itemResult.Seq, Received: itemResult.Received})
+		}
 
-	// Append to the appropriate object
-	targetDir := filepath.Join(configDataDirectory, target)
-	err = os.MkdirAll(targetDir, 0777)
-	if err != nil {
-		http.Error(httpRsp, err.Error(), http.StatusInternalServerError)
-		return
 	}
-	targetFile := filepath.Join(targetDir, time.Now().UTC().Format("2006-01-02")+".json")
-	f, err := os.OpenFile(targetFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+
+	httpRsp.Header().Set("Content-Type", "application/json")
+	httpRsp.WriteHeader(status)
+	httpRsp.Write(append(resultJSON, []byte("\n")...))
+
+}
+
+// Post a single item to a target, returning the outcome along with the HTTP
+// status that describes it
+func postItem(target string, item []byte, wrap string) (result postItemResult, status int) {
+
+	// Ensure that it's JSON, wrapping it in an object if it isn't one and
+	// that was requested
+	var value interface{}
+	err := json.Unmarshal(item, &value)
 	if err != nil {
-		http.Error(httpRsp, err.Error(), http.StatusInternalServerError)
-		return
+		result.Error = err.Error()
+		return result, http.StatusBadRequest
 	}
-	_, err = f.Write(payloadJSON)
-	if err != nil {
-		http.Error(httpRsp, err.Error(), http.StatusInternalServerError)
-		return
+	payloadObject, isObject := value.(map[string]interface{})
+	if !isObject {
+		if wrap == "" {
+			result.Error = "payload is not a JSON object (use ?wrap=1 to store other values)"
+			return result, http.StatusBadRequest
+		}
+		payloadObject = map[string]interface{}{wrap: value}
 	}
-	err = f.Close()
+
+	// Re-marshal it to its compact form
+	payloadJSON, err := json.Marshal(payloadObject)
 	if err != nil {
-		http.Error(httpRsp, err.Error(), http.StatusInternalServerError)
-		return
+		result.Error = err.Error()
+		return result, http.StatusInternalServerError
 	}
 
-	// Send the intended json to the live monitor, if anyone is watching
-	watcherPut(target, payloadJSONIndented)
+	// Reject it if it doesn't conform to the target's schema, first noting it
+	// in the target's stream of rejected posts if that was requested
+	errs, quarantine := schemaValidate(target, payloadObject)
+	if len(errs) > 0 {
+		fmt.Printf("post %s rejected by schema\n", target)
+		result.Error = "payload does not conform to the schema of " + target
+		result.Errors = errs
+		if quarantine {
+			rejectedJSON, err := json.Marshal(rejectedPost{Payload: payloadJSON, Errors: errs})
+			if err == nil {
+				_, err = recordAppend(rejectedTarget(target), rejectedJSON)
+			}
+			if err != nil {
+				fmt.Printf("post %s: can't quarantine: %s\n", target, err)
+			}
+			result.Quarantined = err == nil
+		}
+		return result, http.StatusUnprocessableEntity
+	}
+
+	// Append to the appropriate object, which also sends it to the live
+	// monitor if anyone is watching
+	rec, err := recordAppend(target, payloadJSON)
+	if err != nil {
+		result.Error = err.Error()
+		return result, http.StatusInternalServerError
+	}
+	result.Seq = rec.Seq
+	result.Received = rec.Received
 
+	return result, http.StatusOK
 }
@@ -0,0 +1,172 @@
+// Copyright 2020 Blues Inc.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+// Time-range queries over the stored history of a target
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Maximum number of records returned by a single page of a range query
+const configMaxRangeRecords = 10000
+
+// A position within a target's history, of the form yyyy-mm-dd.N, identifying
+// the Nth record (counting from 0) received on that day.  Positions rather than
+// sequence numbers are used so that records stored before they were numbered
+// may also be paged through.
+type rangeCursor struct {
+	day   string
+	index int
+}
+
+// Parse a cursor supplied by a client
+func rangeParseCursor(s string) (cursor rangeCursor, err error) {
+	i := strings.LastIndex(s, ".")
+	if i < 0 {
+		err = fmt.Errorf("can't parse cursor %s", s)
+		return
+	}
+	cursor.day = s[:i]
+	cursor.index, err = strconv.Atoi(s[i+1:])
+	if err != nil || cursor.index < 0 {
+		err = fmt.Errorf("can't parse cursor %s", s)
+	}
+	return
+}
+
+// Format a cursor for the client
+func (cursor rangeCursor) String() string {
+	return fmt.Sprintf("%s.%d", cursor.day, cursor.index)
+}
+
+// Return all records of a target received at or after start and before end,
+// a page at a time.  A page is rendered as newline-delimited JSON unless
+// another format is requested.  If there are more records, the cursor at which
+// to resume is returned in the X-Next-Cursor header, to be supplied as
+// ?cursor= with the next request.
+func rangeQuery(httpRsp http.ResponseWriter, target string, args map[string]string) {
+
+	// Parse the window, either end of which may be left open
+	var start, end time.Time
+	var err error
+	if args["start"] != "" {
+		start, err = parseTime(args["start"])
+		if err != nil {
+			http.Error(httpRsp, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	if args["end"] != "" {
+		end, err = parseTime(args["end"])
+		if err != nil {
+			http.Error(httpRsp, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	// Parse the paging and filtering args
+	limit := configMaxPosts
+	if args["limit"] != "" {
+		limit, err = strconv.Atoi(args["limit"])
+		if err != nil || limit <= 0 {
+			http.Error(httpRsp, fmt.Sprintf("invalid limit: %s", args["limit"]), http.StatusBadRequest)
+			return
+		}
+	}
+	if limit > configMaxRangeRecords {
+		limit = configMaxRangeRecords
+	}
+	var cursor rangeCursor
+	if args["cursor"] != "" {
+		cursor, err = rangeParseCursor(args["cursor"])
+		if err != nil {
+			http.Error(httpRsp, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	where, err := filterParse(args["where"])
+	if err != nil {
+		http.Error(httpRsp, err.Error(), http.StatusBadRequest)
+		return
+	}
+	of, err := formatParse(args)
+	if err != nil {
+		http.Error(httpRsp, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if of.format == formatDefault {
+		of.format = formatNDJSON
+	}
+
+	fmt.Printf("range %s %s %s\n", target, args["start"], args["end"])
+
+	records, next := recordsRange(target, start, end, cursor, limit, where)
+
+	httpRsp.Header().Set("Content-Type", of.contentType())
+	if next.day != "" {
+		httpRsp.Header().Set("X-Next-Cursor", next.String())
+	}
+	httpRsp.Write(of.render(records))
+
+}
+
+// Read, oldest first, up to limit records received within [start, end) that
+// match the filter, beginning at the cursor.  The days on which records were
+// received are used to skip those entirely outside of the window.  If the limit
+// was reached before the end of the window, the position of the next record is
+// returned.
+func recordsRange(target string, start time.Time, end time.Time, cursor rangeCursor, limit int, where *filter) (records []storedRecord, next rangeCursor) {
+
+	startDay := ""
+	if !start.IsZero() {
+		startDay = start.UTC().Format("2006-01-02")
+	}
+	endDay := ""
+	if !end.IsZero() {
+		endDay = end.UTC().Format("2006-01-02")
+	}
+	if cursor.day > startDay {
+		startDay = cursor.day
+	}
+
+	for _, day := range store.RecordDays(target) {
+		if day < startDay {
+			continue
+		}
+		if endDay != "" && day > endDay {
+			break
+		}
+
+		dayRecords := recordReadDay(target, day)
+		first := 0
+		if day == cursor.day {
+			first = cursor.index
+		}
+		for i := first; i < len(dayRecords); i++ {
+			rec := dayRecords[i]
+			received := rec.receivedTime()
+			if !start.IsZero() && received.Before(start) {
+				continue
+			}
+			if !end.IsZero() && !received.Before(end) {
+				continue
+			}
+			if !where.match(rec.Payload) {
+				continue
+			}
+			if len(records) >= limit {
+				next = rangeCursor{day: day, index: i}
+				return
+			}
+			records = append(records, rec)
+		}
+	}
+
+	return
+}
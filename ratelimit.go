@@ -0,0 +1,200 @@
+// Copyright 2020 Blues Inc.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+// Token-bucket rate limiting of writes to targets, by client address, by the
+// token presented, and by target
+package main
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RateLimit allows Burst requests at once, refilled at Rate requests per
+// second.  A rate of zero means no limit.
+type RateLimit struct {
+	Rate  float64 `json:"rate,omitempty"`
+	Burst int     `json:"burst,omitempty"`
+}
+
+// RateLimitConfig is the set of limits applied to each write, all of which
+// must allow it.  The address of a client is taken from X-Forwarded-For only
+// if the service is known to be behind a proxy that sets it.
+type RateLimitConfig struct {
+	Client            RateLimit `json:"client,omitempty"`
+	Token             RateLimit `json:"token,omitempty"`
+	Target            RateLimit `json:"target,omitempty"`
+	TrustForwardedFor bool      `json:"trust_forwarded_for,omitempty"`
+}
+
+// A bucket of tokens, refilled as of the time last updated
+type rateBucket struct {
+	limit   RateLimit
+	tokens  float64
+	updated time.Time
+}
+
+// The state of a bucket, as reported by the stats endpoint
+type rateBucketStats struct {
+	Key    string  `json:"key"`
+	Tokens float64 `json:"tokens"`
+	Burst  int     `json:"burst"`
+	Rate   float64 `json:"rate"`
+}
+
+// How often buckets that have refilled are discarded
+const rateSweepInterval = time.Minute
+
+// Buckets by key
+var rateLock sync.Mutex
+var rateBuckets = map[string]*rateBucket{}
+var rateLastSweep time.Time
+
+// Refill a bucket as of now
+func (b *rateBucket) refill(now time.Time) {
+	b.tokens = math.Min(float64(b.limit.Burst), b.tokens+now.Sub(b.updated).Seconds()*b.limit.Rate)
+	b.updated = now
+}
+
+// Get the address of a client
+func rateClient(httpReq *http.Request) string {
+	if Config.RateLimit.TrustForwardedFor {
+		forwarded := httpReq.Header.Get("X-Forwarded-For")
+		if forwarded != "" {
+			return strings.TrimSpace(strings.Split(forwarded, ",")[0])
+		}
+	}
+	host, _, err := net.SplitHostPort(httpReq.RemoteAddr)
+	if err != nil {
+		return httpReq.RemoteAddr
+	}
+	return host
+}
+
+// Take tokens from each of the buckets that apply to a write, if all have
+// enough to give, else return the key of a bucket that is short and how long
+// until it will have enough.  A write costing more than a bucket can hold is
+// allowed once the bucket is full, leaving it in debt, so that a large batch
+// is refused no more often than it is paid for.
+func rateTake(limits map[string]RateLimit, cost int) (limited string, retryAfter time.Duration) {
+
+	rateLock.Lock()
+	defer rateLock.Unlock()
+
+	now := time.Now()
+	rateSweep(now)
+
+	// Find the buckets, refilling them
+	buckets := map[string]*rateBucket{}
+	for key, limit := range limits {
+		if limit.Rate <= 0 {
+			continue
+		}
+		if limit.Burst < 1 {
+			limit.Burst = 1
+		}
+		b, present := rateBuckets[key]
+		if !present || b.limit != limit {
+			b = &rateBucket{limit: limit, tokens: float64(limit.Burst), updated: now}
+			rateBuckets[key] = b
+		}
+		b.refill(now)
+		buckets[key] = b
+	}
+
+	// Refuse if any is short, reporting the one that will take longest to refill
+	for key, b := range buckets {
+		needed := math.Min(float64(cost), float64(b.limit.Burst))
+		if b.tokens < needed {
+			wait := time.Duration((needed - b.tokens) / b.limit.Rate * float64(time.Second))
+			if wait > retryAfter {
+				limited = key
+				retryAfter = wait
+			}
+		}
+	}
+	if limited != "" {
+		return
+	}
+
+	for _, b := range buckets {
+		b.tokens -= float64(cost)
+	}
+
+	return
+}
+
+// Discard the buckets that have refilled, which are no different than new
+// ones, with the lock held
+func rateSweep(now time.Time) {
+	if now.Sub(rateLastSweep) < rateSweepInterval {
+		return
+	}
+	rateLastSweep = now
+	for key, b := range rateBuckets {
+		b.refill(now)
+		if b.tokens >= float64(b.limit.Burst) {
+			delete(rateBuckets, key)
+		}
+	}
+}
+
+// Check that a write to a target, costing a token for each record or file
+// written, is within the configured limits, replying with an error if not.
+// The target is the one actually written, whose files and rejected posts, if
+// named by path, are charged to the target itself.
+func rateCheck(httpRsp http.ResponseWriter, httpReq *http.Request, args map[string]string, target string, cost int) bool {
+
+	if cost < 1 {
+		return true
+	}
+	limits := map[string]RateLimit{
+		"client:" + rateClient(httpReq): Config.RateLimit.Client,
+		"target:" + authOwner(target):   Config.RateLimit.Target,
+	}
+	token := authPresented(httpReq, args)
+	if token != "" {
+		limits["token:"+authHash(token)[:12]] = Config.RateLimit.Token
+	}
+
+	limited, retryAfter := rateTake(limits, cost)
+	if limited == "" {
+		return true
+	}
+
+	seconds := int(math.Ceil(retryAfter.Seconds()))
+	fmt.Printf("rate limited %s\n", limited)
+	httpRsp.Header().Set("Retry-After", strconv.Itoa(seconds))
+	http.Error(httpRsp, fmt.Sprintf("rate limit exceeded for %s, retry after %ds", limited, seconds), http.StatusTooManyRequests)
+	return false
+}
+
+// Get the state of the buckets that aren't full
+func rateStats() (stats []rateBucketStats) {
+
+	rateLock.Lock()
+	defer rateLock.Unlock()
+
+	now := time.Now()
+	stats = []rateBucketStats{}
+	for key, b := range rateBuckets {
+		b.refill(now)
+		if b.tokens >= float64(b.limit.Burst) {
+			continue
+		}
+		stats = append(stats, rateBucketStats{Key: key, Tokens: math.Floor(b.tokens*100) / 100, Burst: b.limit.Burst, Rate: b.limit.Rate})
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		return stats[i].Key < stats[j].Key
+	})
+
+	return
+}
@@ -0,0 +1,252 @@
+// Copyright 2020 Blues Inc.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+// Records as stored in a target's history
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// The format of the server receive time within a stored record
+const recordTimeFormat = "2006-01-02T15:04:05.000Z"
+
+// A record as stored, for example one per line in a target's yyyy-mm-dd.json
+// files, as {"seq":<n>,"received":"<time>","payload":<the JSON posted>}.
+// Before records were enveloped each line was the posted JSON alone, and files
+// written then are never rewritten.  Such lines are read as records with no
+// sequence number, received at the start of the day named by the file, whose
+// payload is the whole line.  A target's numbering continues after the highest
+// number found, and so begins at 1 for a target having only such lines.  Tools
+// that read the day files directly must take each record's payload from its
+// envelope, while those reading through tail and watch see payloads as before.
+type storedRecord struct {
+	Seq      int64           `json:"seq"`
+	Received string          `json:"received"`
+	Payload  json.RawMessage `json:"payload"`
+}
+
+// The sequence numbering of a target's records.  A target's numbers are
+// allocated, and its records appended, under its own lock so that the order of
+// its records in the store matches the order of their numbers, while targets
+// are written independently of one another.
+type recordSequence struct {
+	lock      sync.Mutex
+	recovered bool
+	lastSeq   int64
+}
+
+var recordSequencesLock sync.Mutex
+var recordSequences = map[string]*recordSequence{}
+
+// Get the sequence numbering of a target
+func recordSequenceFor(target string) (seq *recordSequence) {
+	recordSequencesLock.Lock()
+	defer recordSequencesLock.Unlock()
+	seq = recordSequences[target]
+	if seq == nil {
+		seq = &recordSequence{}
+		recordSequences[target] = seq
+	}
+	return
+}
+
+// Append a record to the target's records for today, and send it to the live
+// monitor.  Watchers are fed under the target's lock so that they too see its
+// records in sequence order, which is what allows replay to switch to live
+// data without duplicates or gaps.
+func recordAppend(target string, payload []byte) (rec storedRecord, err error) {
+
+	seq := recordSequenceFor(target)
+	seq.lock.Lock()
+	defer seq.lock.Unlock()
+
+	// Recover the last sequence number from the store the first time we see the target
+	if !seq.recovered {
+		seq.lastSeq = recordRecoverSeq(target)
+		seq.recovered = true
+	}
+
+	now := time.Now().UTC()
+	rec.Seq = seq.lastSeq + 1
+	rec.Received = now.Format(recordTimeFormat)
+	rec.Payload = payload
+	err = store.AppendRecord(target, now.Format("2006-01-02"), rec)
+	if err != nil {
+		return
+	}
+	seq.lastSeq = rec.Seq
+
+	watcherPut(target, rec)
+
+	return
+
+}
+
+// Find the highest sequence number among the target's most recent records
+func recordRecoverSeq(target string) (lastSeq int64) {
+	days := store.RecordDays(target)
+	for i := len(days) - 1; i >= 0 && lastSeq == 0; i-- {
+		for _, rec := range recordReadDay(target, days[i]) {
+			if rec.Seq > lastSeq {
+				lastSeq = rec.Seq
+			}
+		}
+	}
+	return
+}
+
+// Read all records of a target received on a day, oldest first
+func recordReadDay(target string, day string) (records []storedRecord) {
+	records, err := store.ReadRecords(target, day)
+	if err != nil {
+		fmt.Printf("can't read %s %s: %s\n", target, day, err)
+	}
+	return
+}
+
+// Parse a single line of a daily file
+func recordParse(line []byte, day string) (rec storedRecord) {
+	err := json.Unmarshal(line, &rec)
+	if err == nil && rec.Seq > 0 && rec.Received != "" && len(rec.Payload) > 0 {
+		return
+	}
+	rec = storedRecord{}
+	rec.Received = day + "T00:00:00.000Z"
+	rec.Payload = line
+	return
+}
+
+// Get the time at which a record was received
+func (rec storedRecord) receivedTime() (t time.Time) {
+	t, _ = time.Parse(recordTimeFormat, rec.Received)
+	return
+}
+
+// Read, oldest first, the records of a target that are at or after the given
+// sequence number and at or after the given time.  Days are read newest first
+// so that we stop as soon as we have passed the cursor.
+func recordsFrom(target string, fromSeq int64, since time.Time) (records []storedRecord) {
+
+	sinceDay := ""
+	if !since.IsZero() {
+		sinceDay = since.UTC().Format("2006-01-02")
+	}
+
+	days := store.RecordDays(target)
+	for i := len(days) - 1; i >= 0; i-- {
+
+		// Days before the day of the cursor can be skipped entirely
+		if days[i] < sinceDay {
+			break
+		}
+
+		var matched []storedRecord
+		passed := false
+		for _, rec := range recordReadDay(target, days[i]) {
+			if rec.Seq < fromSeq || (!since.IsZero() && rec.receivedTime().Before(since)) {
+				passed = true
+				continue
+			}
+			matched = append(matched, rec)
+		}
+		records = append(matched, records...)
+
+		if passed {
+			break
+		}
+
+	}
+
+	return
+}
+
+// List every stream of records, being those of the targets along with their
+// streams of posts rejected by a schema
+func recordTargets() (targets []string) {
+	for _, target := range tailTargets() {
+		targets = append(targets, target)
+		if len(store.RecordDays(rejectedTarget(target))) > 0 {
+			targets = append(targets, rejectedTarget(target))
+		}
+	}
+	return
+}
+
+// Find a record of a target by its sequence number.  Days are read newest
+// first, stopping at the first day that begins before the wanted record.
+func recordFind(target string, seq int64) (rec storedRecord, found bool) {
+
+	if seq <= 0 {
+		return
+	}
+
+	days := store.RecordDays(target)
+	for i := len(days) - 1; i >= 0; i-- {
+		records := recordReadDay(target, days[i])
+		for _, rec = range records {
+			if rec.Seq == seq {
+				found = true
+				return
+			}
+		}
+		if len(records) > 0 && records[0].Seq > 0 && records[0].Seq < seq {
+			break
+		}
+	}
+
+	rec = storedRecord{}
+	return
+}
+
+// Serve a single record of a target, looked up by its sequence number
+func getRecord(httpRsp http.ResponseWriter, target string, seqStr string) {
+
+	seq, err := strconv.ParseInt(seqStr, 10, 64)
+	if err != nil || seq <= 0 {
+		http.Error(httpRsp, fmt.Sprintf("invalid sequence number: %s", seqStr), http.StatusBadRequest)
+		return
+	}
+
+	fmt.Printf("record %s %d\n", target, seq)
+
+	rec, found := recordFind(target, seq)
+	if !found {
+		http.Error(httpRsp, fmt.Sprintf("record %d not found", seq), http.StatusNotFound)
+		return
+	}
+	recJSON, err := json.Marshal(rec)
+	if err != nil {
+		http.Error(httpRsp, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	httpRsp.Header().Set("Content-Type", "application/json")
+	httpRsp.Write(append(recJSON, []byte("\n")...))
+
+}
+
+// Parse a time supplied by a client, either in RFC3339 form or as
+// (possibly fractional) seconds since the epoch
+func parseTime(s string) (t time.Time, err error) {
+	if s == "" {
+		err = fmt.Errorf("no time specified")
+		return
+	}
+	secs, err := strconv.ParseFloat(s, 64)
+	if err == nil {
+		t = time.Unix(0, int64(secs*float64(time.Second))).UTC()
+		return
+	}
+	t, err = time.Parse(time.RFC3339Nano, s)
+	if err != nil {
+		err = fmt.Errorf("can't parse time %s: must be RFC3339 or epoch seconds", s)
+	}
+	return
+}
@@ -0,0 +1,195 @@
+// Copyright 2020 Blues Inc.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+// Per-target retention of records and photos
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// RetentionPolicy limits how much of a target's history is kept.  Records are
+// discarded a whole day at a time, oldest first, so that at least MaxRecords
+// records or MaxBytes bytes are always retained; days that ended more than
+// MaxAgeDays days ago are discarded regardless.  A limit of zero means no limit,
+// except that MaxPhotos defaults to configMaxPhotos, as it did before policies
+// could be configured, and a MaxPhotos of -1 keeps every photo.
+type RetentionPolicy struct {
+	MaxRecords int   `json:"max_records,omitempty"`
+	MaxAgeDays int   `json:"max_age_days,omitempty"`
+	MaxBytes   int64 `json:"max_bytes,omitempty"`
+	MaxPhotos  int   `json:"max_photos,omitempty"`
+	NeverPurge bool  `json:"never_purge,omitempty"`
+}
+
+// The key, within the retention config, of the policy for all other targets
+const retentionDefaultKey = "*"
+
+// The blob in which policies set through the admin API are kept
+const retentionBlobName = ".retention.json"
+
+// The built-in policies, used when no policy is configured
+var retentionBuiltinDefault = RetentionPolicy{MaxRecords: configMaxPosts, MaxPhotos: configMaxPhotos}
+var retentionBuiltin = map[string]RetentionPolicy{
+	"health": {NeverPurge: true},
+}
+
+// What was discarded from a target by a purge
+type retentionReport struct {
+	Target  string `json:"target"`
+	Days    int    `json:"days,omitempty"`
+	Records int    `json:"records,omitempty"`
+	Bytes   int64  `json:"bytes,omitempty"`
+}
+
+// Policies set through the admin API, which take precedence over the config,
+// along with the results of the most recent purge
+var retentionLock sync.Mutex
+var retentionOverrides = map[string]RetentionPolicy{}
+var retentionLastPurge time.Time
+var retentionLastReports = []retentionReport{}
+
+// Get the policy in effect for a target.  A policy applies in its entirety, so
+// that a target's policy doesn't inherit limits from the default policy.
+func retentionPolicyFor(target string) (policy RetentionPolicy) {
+
+	retentionLock.Lock()
+	defer retentionLock.Unlock()
+
+	for _, policies := range []map[string]RetentionPolicy{retentionOverrides, Config.Retention, retentionBuiltin} {
+		policy, present := policies[target]
+		if present {
+			return policy
+		}
+	}
+	for _, policies := range []map[string]RetentionPolicy{retentionOverrides, Config.Retention} {
+		policy, present := policies[retentionDefaultKey]
+		if present {
+			return policy
+		}
+	}
+
+	return retentionBuiltinDefault
+}
+
+// Load the policies previously set through the admin API
+func retentionLoad() {
+
+	contents, err := store.GetBlob(retentionBlobName)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			fmt.Printf("retention: can't load policies: %s\n", err)
+		}
+		return
+	}
+
+	retentionLock.Lock()
+	err = json.Unmarshal(contents, &retentionOverrides)
+	retentionLock.Unlock()
+	if err != nil {
+		fmt.Printf("retention: can't parse policies: %s\n", err)
+	}
+
+}
+
+// Set or, if policy is nil, remove the admin policy for a target, and save
+// the admin policies
+func retentionSet(target string, policy *RetentionPolicy) (err error) {
+
+	retentionLock.Lock()
+	if policy == nil {
+		delete(retentionOverrides, target)
+	} else {
+		retentionOverrides[target] = *policy
+	}
+	contents, err := json.Marshal(retentionOverrides)
+	retentionLock.Unlock()
+	if err != nil {
+		return
+	}
+
+	return store.PutBlob(retentionBlobName, contents, false)
+
+}
+
+// Discard the records of a target that fall outside of its policy
+func retentionPurge(target string) (report retentionReport) {
+
+	report.Target = target
+
+	policy := retentionPolicyFor(target)
+	if policy.NeverPurge {
+		return
+	}
+
+	// Days before this one are discarded by age
+	cutoffDay := ""
+	if policy.MaxAgeDays > 0 {
+		cutoffDay = time.Now().UTC().AddDate(0, 0, -policy.MaxAgeDays).Format("2006-01-02")
+	}
+
+	// Walk the days newest first, keeping them until a limit is reached and
+	// discarding all days older than that
+	days := store.RecordDays(target)
+	keeping := true
+	records := 0
+	bytes := int64(0)
+	for i := len(days) - 1; i >= 0; i-- {
+		dayBytes := store.RecordBytes(target, days[i])
+
+		if keeping && days[i] >= cutoffDay {
+			if policy.MaxRecords > 0 {
+				records += store.RecordCount(target, days[i])
+			}
+			bytes += dayBytes
+			if (policy.MaxRecords > 0 && records >= policy.MaxRecords) || (policy.MaxBytes > 0 && bytes >= policy.MaxBytes) {
+				keeping = false
+			}
+			continue
+		}
+		keeping = false
+
+		dayRecords := store.RecordCount(target, days[i])
+		err := store.PurgeRecords(target, days[i])
+		if err != nil {
+			fmt.Printf("purge %s %s: %s\n", target, days[i], err)
+			continue
+		}
+		fmt.Printf("purged %s %s (%d records, %d bytes)\n", target, days[i], dayRecords, dayBytes)
+		report.Days++
+		report.Records += dayRecords
+		report.Bytes += dayBytes
+	}
+
+	return
+}
+
+// Apply the retention policies to every target, noting what was discarded
+func retentionPurgeAll() {
+
+	reports := []retentionReport{}
+	for _, target := range recordTargets() {
+		report := retentionPurge(target)
+		if report.Days > 0 {
+			reports = append(reports, report)
+		}
+	}
+	sort.Slice(reports, func(i, j int) bool {
+		return reports[i].Target < reports[j].Target
+	})
+
+	retentionLock.Lock()
+	retentionLastPurge = time.Now().UTC()
+	retentionLastReports = reports
+	retentionLock.Unlock()
+
+	fmt.Printf("retention: purged records from %d targets\n", len(reports))
+
+}
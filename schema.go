@@ -0,0 +1,196 @@
+// Copyright 2020 Blues Inc.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+// Validation of posts against a JSON Schema attached to their target
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/santhosh-tekuri/jsonschema/v5"
+)
+
+// The blob, within a target, in which its schema is kept
+const schemaBlobName = ".schema.json"
+
+// The suffix of the target to which posts that were rejected by a target's
+// schema are appended, if it was attached with quarantine enabled
+const rejectedSuffix = "/.rejected"
+
+// A schema as stored, along with whether rejected posts are quarantined
+type targetSchema struct {
+	Quarantine bool            `json:"quarantine,omitempty"`
+	Schema     json.RawMessage `json:"schema"`
+}
+
+// A schema compiled and ready to validate with
+type compiledSchema struct {
+	quarantine bool
+	schema     *jsonschema.Schema
+}
+
+// A reason that a post was rejected, identifying by JSON pointer both the
+// offending value and the schema keyword that it failed
+type schemaError struct {
+	Path    string `json:"path"`
+	Keyword string `json:"keyword"`
+	Error   string `json:"error"`
+}
+
+// A post rejected by a schema, as recorded in the quarantine stream
+type rejectedPost struct {
+	Payload json.RawMessage `json:"payload"`
+	Errors  []schemaError   `json:"errors"`
+}
+
+// Compiled schemas by target, where nil means that a target has no schema
+var schemaLock sync.Mutex
+var schemaCache = map[string]*compiledSchema{}
+
+// Get the name of the target's stream of rejected posts
+func rejectedTarget(target string) string {
+	return target + rejectedSuffix
+}
+
+// Compile a schema, refusing to follow references to other documents so that
+// a schema can't be used to read files or reach other hosts
+func schemaCompile(target string, schemaJSON []byte) (schema *jsonschema.Schema, err error) {
+
+	url := "myjson:///" + target + "/" + schemaBlobName
+	compiler := jsonschema.NewCompiler()
+	compiler.LoadURL = func(s string) (io.ReadCloser, error) {
+		return nil, fmt.Errorf("can't load %s: references to other schemas are not supported", s)
+	}
+	err = compiler.AddResource(url, bytes.NewReader(schemaJSON))
+	if err != nil {
+		return
+	}
+
+	return compiler.Compile(url)
+}
+
+// Get the schema of a target, loading and compiling it if necessary
+func schemaFor(target string) (cs *compiledSchema) {
+
+	schemaLock.Lock()
+	defer schemaLock.Unlock()
+
+	cs, present := schemaCache[target]
+	if present {
+		return
+	}
+
+	contents, err := store.GetBlob(target + "/" + schemaBlobName)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			fmt.Printf("schema %s: %s\n", target, err)
+		}
+		schemaCache[target] = nil
+		return nil
+	}
+
+	var ts targetSchema
+	err = json.Unmarshal(contents, &ts)
+	if err == nil {
+		cs = &compiledSchema{quarantine: ts.Quarantine}
+		cs.schema, err = schemaCompile(target, ts.Schema)
+	}
+	if err != nil {
+		fmt.Printf("schema %s: %s\n", target, err)
+		cs = nil
+	}
+	schemaCache[target] = cs
+
+	return
+}
+
+// Get the schema of a target as it was attached
+func schemaGet(target string) (ts targetSchema, err error) {
+	contents, err := store.GetBlob(target + "/" + schemaBlobName)
+	if err != nil {
+		return
+	}
+	err = json.Unmarshal(contents, &ts)
+	return
+}
+
+// Attach a schema to a target, replacing any that was attached before
+func schemaSet(target string, schemaJSON []byte, quarantine bool) (err error) {
+
+	schema, err := schemaCompile(target, schemaJSON)
+	if err != nil {
+		return
+	}
+
+	contents, err := json.Marshal(targetSchema{Quarantine: quarantine, Schema: schemaJSON})
+	if err != nil {
+		return
+	}
+
+	schemaLock.Lock()
+	defer schemaLock.Unlock()
+	err = store.PutBlob(target+"/"+schemaBlobName, contents, false)
+	if err != nil {
+		return
+	}
+	schemaCache[target] = &compiledSchema{quarantine: quarantine, schema: schema}
+
+	return
+}
+
+// Detach the schema of a target
+func schemaDelete(target string) (err error) {
+
+	schemaLock.Lock()
+	defer schemaLock.Unlock()
+	err = store.DeleteBlob(target + "/" + schemaBlobName)
+	if err != nil {
+		return
+	}
+	schemaCache[target] = nil
+
+	return
+}
+
+// Validate a post against the schema of its target, if it has one, returning
+// the most specific reasons for which it failed
+func schemaValidate(target string, payload interface{}) (errs []schemaError, quarantine bool) {
+
+	cs := schemaFor(target)
+	if cs == nil {
+		return
+	}
+	quarantine = cs.quarantine
+
+	err := cs.schema.Validate(payload)
+	if err == nil {
+		return
+	}
+	ve, isValidationError := err.(*jsonschema.ValidationError)
+	if !isValidationError {
+		errs = append(errs, schemaError{Error: err.Error()})
+		return
+	}
+
+	// Report the leaves of the tree of failures, which are the failures that
+	// caused all of the others
+	var flatten func(ve *jsonschema.ValidationError)
+	flatten = func(ve *jsonschema.ValidationError) {
+		if len(ve.Causes) == 0 {
+			errs = append(errs, schemaError{Path: ve.InstanceLocation, Keyword: ve.KeywordLocation, Error: ve.Message})
+		}
+		for _, cause := range ve.Causes {
+			flatten(cause)
+		}
+	}
+	flatten(ve)
+
+	return
+}
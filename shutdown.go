@@ -0,0 +1,114 @@
+// Copyright 2020 Blues Inc.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+// Graceful shutdown, in which the HTTP server stops accepting connections,
+// watchers are told that the service is going away, and the requests and
+// background work that are in progress are given until a deadline to finish
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// How long to wait for work in progress to finish, unless configured otherwise
+const configShutdownDeadline = 30 * time.Second
+
+// The HTTP servers, once started
+var httpServers []*http.Server
+var httpServersLock sync.Mutex
+
+// Work done in the background on behalf of requests, such as the writing of
+// uploaded files, which must finish before the process exits
+var shutdownTasks sync.WaitGroup
+
+// The context of all requests, which is cancelled if work in progress hasn't
+// finished by the deadline so that long-lived requests such as watches end
+var shutdownContext, shutdownCancel = context.WithCancel(context.Background())
+
+// Ensure that shutdown happens just once
+var shutdownOnce sync.Once
+
+// Register an HTTP server to be shut down
+func shutdownRegister(server *http.Server) {
+	httpServersLock.Lock()
+	httpServers = append(httpServers, server)
+	httpServersLock.Unlock()
+}
+
+// Run a task in the background that must finish before the process exits
+func shutdownGo(task func()) {
+	shutdownTasks.Add(1)
+	go func() {
+		defer shutdownTasks.Done()
+		task()
+	}()
+}
+
+// Shut down gracefully and exit.  This blocks until the process exits, and so
+// should be run on a goroutine of its own by an HTTP handler, whose request
+// would otherwise be waited upon.
+func shutdown(reason string) {
+	shutdownOnce.Do(func() {
+
+		deadline := configShutdownDeadline
+		if Config.ShutdownSeconds > 0 {
+			deadline = time.Duration(Config.ShutdownSeconds) * time.Second
+		}
+		fmt.Printf("*** SHUTTING DOWN because %s (waiting up to %s)\n", reason, deadline)
+		ctx, cancel := context.WithTimeout(context.Background(), deadline)
+		defer cancel()
+
+		// Tell watchers that we're going away, which ends their requests
+		watcherShutdown()
+
+		// Stop accepting connections, and wait for requests in progress,
+		// including the processing of audio, to finish
+		httpServersLock.Lock()
+		servers := httpServers
+		httpServersLock.Unlock()
+		var wg sync.WaitGroup
+		for _, server := range servers {
+			wg.Add(1)
+			go func(server *http.Server) {
+				defer wg.Done()
+				err := server.Shutdown(ctx)
+				if err != nil {
+					fmt.Printf("shutdown: %s: %s\n", server.Addr, err)
+					server.Close()
+				}
+			}(server)
+		}
+		wg.Wait()
+
+		// Wait for background work, such as the writing of uploads
+		done := make(chan struct{})
+		go func() {
+			shutdownTasks.Wait()
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-ctx.Done():
+			fmt.Printf("shutdown: gave up waiting for background work\n")
+		}
+
+		// End whatever requests remain, such as hijacked websockets, and close
+		// the store so that it's left consistent
+		shutdownCancel()
+		err := store.Close()
+		if err != nil {
+			fmt.Printf("shutdown: can't close store: %s\n", err)
+		}
+
+		fmt.Printf("*** EXITING\n")
+		os.Exit(0)
+
+	})
+	select {}
+}
@@ -0,0 +1,453 @@
+// Copyright 2020 Blues Inc.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+// An embedded database store, for larger deployments that want indexed
+// lookups and atomic writes.  Records are kept in a bucket per target and,
+// within it, a bucket per day keyed by the record's index within that day.
+// Blobs are kept in a single bucket keyed by name, alongside a bucket of
+// their modification times.
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// Top-level buckets
+var (
+	boltRecordsBucket = []byte("records")
+	boltBlobsBucket   = []byte("blobs")
+	boltMtimesBucket  = []byte("mtimes")
+)
+
+// The bolt store
+type boltStore struct {
+	db *bolt.DB
+}
+
+// Open the database, creating it and its top-level buckets if necessary
+func boltStoreOpen(pathname string) (s *boltStore, err error) {
+
+	db, err := bolt.Open(pathname, 0644, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{boltRecordsBucket, boltBlobsBucket, boltMtimesBucket} {
+			_, err := tx.CreateBucketIfNotExists(name)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return
+	}
+
+	s = &boltStore{db: db}
+	return
+}
+
+// List the targets having either records or blobs
+func (s *boltStore) ListTargets() (targets []string) {
+
+	found := map[string]bool{}
+	s.db.View(func(tx *bolt.Tx) error {
+		tx.Bucket(boltRecordsBucket).ForEach(func(k, v []byte) error {
+			found[strings.Split(string(k), "/")[0]] = true
+			return nil
+		})
+		return tx.Bucket(boltBlobsBucket).ForEach(func(k, v []byte) error {
+			found[strings.Split(string(k), "/")[0]] = true
+			return nil
+		})
+	})
+
+	for target := range found {
+		if !strings.HasPrefix(target, ".") {
+			targets = append(targets, target)
+		}
+	}
+	sort.Strings(targets)
+
+	return
+}
+
+// List the day buckets of a target, which bolt keeps in sorted order
+func (s *boltStore) RecordDays(target string) (days []string) {
+	s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(boltRecordsBucket).Bucket([]byte(target))
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(k, v []byte) error {
+			days = append(days, string(k))
+			return nil
+		})
+	})
+	return
+}
+
+// Read the records of a day, in index order
+func (s *boltStore) ReadRecords(target string, day string) (records []storedRecord, err error) {
+	err = s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(boltRecordsBucket).Bucket([]byte(target))
+		if b != nil {
+			b = b.Bucket([]byte(day))
+		}
+		if b == nil {
+			return os.ErrNotExist
+		}
+		return b.ForEach(func(k, v []byte) error {
+			records = append(records, recordParse(bytes.Clone(v), day))
+			return nil
+		})
+	})
+	return
+}
+
+// Append a record to a day, keyed by the next index within that day
+func (s *boltStore) AppendRecord(target string, day string, rec storedRecord) (err error) {
+
+	recJSON, err := json.Marshal(rec)
+	if err != nil {
+		return
+	}
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.Bucket(boltRecordsBucket).CreateBucketIfNotExists([]byte(target))
+		if err != nil {
+			return err
+		}
+		b, err = b.CreateBucketIfNotExists([]byte(day))
+		if err != nil {
+			return err
+		}
+		index, err := b.NextSequence()
+		if err != nil {
+			return err
+		}
+		key := make([]byte, 8)
+		binary.BigEndian.PutUint64(key, index)
+		return b.Put(key, recJSON)
+	})
+
+}
+
+// Sum the sizes of the records of a day
+func (s *boltStore) RecordBytes(target string, day string) (size int64) {
+	s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(boltRecordsBucket).Bucket([]byte(target))
+		if b != nil {
+			b = b.Bucket([]byte(day))
+		}
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(k, v []byte) error {
+			size += int64(len(v))
+			return nil
+		})
+	})
+	return
+}
+
+// Count the keys of the bucket for a day
+func (s *boltStore) RecordCount(target string, day string) (count int) {
+	s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(boltRecordsBucket).Bucket([]byte(target))
+		if b != nil {
+			b = b.Bucket([]byte(day))
+		}
+		if b != nil {
+			count = b.Stats().KeyN
+		}
+		return nil
+	})
+	return
+}
+
+// Delete the bucket for a day
+func (s *boltStore) PurgeRecords(target string, day string) (err error) {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(boltRecordsBucket).Bucket([]byte(target))
+		if b == nil {
+			return os.ErrNotExist
+		}
+		return b.DeleteBucket([]byte(day))
+	})
+}
+
+// Nothing to do, as bolt reuses the pages freed by purging
+func (s *boltStore) CompactRecords(target string) {
+}
+
+// Validate the name of a blob, using the same rules as for files
+func boltBlobKey(name string) (key []byte, err error) {
+	_, bad := cleanFilename(name)
+	if bad {
+		err = fmt.Errorf("invalid filename: %s", name)
+		return
+	}
+	key = []byte(name)
+	return
+}
+
+// Write or append to a blob
+func (s *boltStore) PutBlob(name string, contents []byte, append bool) (err error) {
+
+	key, err := boltBlobKey(name)
+	if err != nil {
+		return
+	}
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		blobs := tx.Bucket(boltBlobsBucket)
+		value := contents
+		if append {
+			value = bytes.Join([][]byte{blobs.Get(key), contents}, nil)
+		}
+		err := blobs.Put(key, value)
+		if err != nil {
+			return err
+		}
+		mtime := make([]byte, 8)
+		binary.BigEndian.PutUint64(mtime, uint64(time.Now().UnixNano()))
+		return tx.Bucket(boltMtimesBucket).Put(key, mtime)
+	})
+
+}
+
+// Blobs are on disk once the transaction that wrote them has committed
+func (s *boltStore) SyncBlob(name string) (err error) {
+	_, err = boltBlobKey(name)
+	return
+}
+
+// Read a blob
+func (s *boltStore) GetBlob(name string) (contents []byte, err error) {
+
+	key, err := boltBlobKey(name)
+	if err != nil {
+		return
+	}
+
+	err = s.db.View(func(tx *bolt.Tx) error {
+		value := tx.Bucket(boltBlobsBucket).Get(key)
+		if value == nil {
+			return fmt.Errorf("open %s: %w", name, os.ErrNotExist)
+		}
+		contents = bytes.Clone(value)
+		return nil
+	})
+
+	return
+}
+
+// Get the size and modification time of a blob, from the length of its value
+// and its entry in the mtimes bucket, without copying the value
+func (s *boltStore) StatBlob(name string) (info blobInfo, err error) {
+
+	key, err := boltBlobKey(name)
+	if err != nil {
+		return
+	}
+
+	err = s.db.View(func(tx *bolt.Tx) error {
+		value := tx.Bucket(boltBlobsBucket).Get(key)
+		if value == nil {
+			return fmt.Errorf("stat %s: %w", name, os.ErrNotExist)
+		}
+		info = blobInfo{name: path.Base(name), size: int64(len(value))}
+		mtime := tx.Bucket(boltMtimesBucket).Get(key)
+		if len(mtime) == 8 {
+			info.modTime = time.Unix(0, int64(binary.BigEndian.Uint64(mtime)))
+		}
+		return nil
+	})
+
+	return
+}
+
+// Open a blob to be read.  Values are only valid within the transaction
+// that read them, so the blob is copied, and read from memory.
+func (s *boltStore) OpenBlob(name string) (r io.ReadSeekCloser, info blobInfo, err error) {
+
+	key, err := boltBlobKey(name)
+	if err != nil {
+		return
+	}
+
+	var contents []byte
+	err = s.db.View(func(tx *bolt.Tx) error {
+		value := tx.Bucket(boltBlobsBucket).Get(key)
+		if value == nil {
+			return fmt.Errorf("open %s: %w", name, os.ErrNotExist)
+		}
+		contents = bytes.Clone(value)
+		info = blobInfo{name: path.Base(name), size: int64(len(value))}
+		mtime := tx.Bucket(boltMtimesBucket).Get(key)
+		if len(mtime) == 8 {
+			info.modTime = time.Unix(0, int64(binary.BigEndian.Uint64(mtime)))
+		}
+		return nil
+	})
+	if err != nil {
+		return
+	}
+
+	r = nopSeekCloser{bytes.NewReader(contents)}
+	return
+}
+
+// A reader of memory that needs no closing
+type nopSeekCloser struct {
+	io.ReadSeeker
+}
+
+// Close does nothing
+func (nopSeekCloser) Close() error {
+	return nil
+}
+
+// Delete a blob
+func (s *boltStore) DeleteBlob(name string) (err error) {
+
+	key, err := boltBlobKey(name)
+	if err != nil {
+		return
+	}
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		blobs := tx.Bucket(boltBlobsBucket)
+		if blobs.Get(key) == nil {
+			return fmt.Errorf("remove %s: %w", name, os.ErrNotExist)
+		}
+		err := blobs.Delete(key)
+		if err != nil {
+			return err
+		}
+		return tx.Bucket(boltMtimesBucket).Delete(key)
+	})
+
+}
+
+// Rename a blob, moving its contents and modification time to the new key
+// within a single transaction
+func (s *boltStore) RenameBlob(from string, to string) (err error) {
+
+	fromKey, err := boltBlobKey(from)
+	if err != nil {
+		return
+	}
+	toKey, err := boltBlobKey(to)
+	if err != nil {
+		return
+	}
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		blobs := tx.Bucket(boltBlobsBucket)
+		mtimes := tx.Bucket(boltMtimesBucket)
+		value := blobs.Get(fromKey)
+		if value == nil {
+			return fmt.Errorf("rename %s: %w", from, os.ErrNotExist)
+		}
+		// Values are only valid for the life of the transaction, and so are
+		// copied before the key that holds them is deleted
+		value = append([]byte{}, value...)
+		mtime := append([]byte{}, mtimes.Get(fromKey)...)
+		err := blobs.Put(toKey, value)
+		if err == nil {
+			err = mtimes.Put(toKey, mtime)
+		}
+		if err == nil {
+			err = blobs.Delete(fromKey)
+		}
+		if err == nil {
+			err = mtimes.Delete(fromKey)
+		}
+		return err
+	})
+
+}
+
+// List the blobs directly within a directory, by scanning the keys that have
+// the directory as their prefix
+func (s *boltStore) ListBlobs(dir string) (blobs []blobInfo, err error) {
+
+	_, err = boltBlobKey(dir)
+	if err != nil {
+		return
+	}
+	prefix := []byte(strings.TrimSuffix(dir, "/") + "/")
+
+	err = s.db.View(func(tx *bolt.Tx) error {
+		mtimes := tx.Bucket(boltMtimesBucket)
+		c := tx.Bucket(boltBlobsBucket).Cursor()
+		for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+			name := string(k[len(prefix):])
+			if strings.Contains(name, "/") {
+				continue
+			}
+			blob := blobInfo{name: name, size: int64(len(v))}
+			mtime := mtimes.Get(k)
+			if len(mtime) == 8 {
+				blob.modTime = time.Unix(0, int64(binary.BigEndian.Uint64(mtime)))
+			}
+			blobs = append(blobs, blob)
+		}
+		return nil
+	})
+
+	return
+}
+
+// List the blobs whose names begin with a directory, named relative to it.  A
+// directory exists only by way of the blobs within it, and so is missing if
+// there are none.
+func (s *boltStore) ListBlobTree(dir string) (blobs []blobInfo, err error) {
+
+	_, err = boltBlobKey(dir)
+	if err != nil {
+		return
+	}
+	prefix := []byte(strings.TrimSuffix(dir, "/") + "/")
+
+	err = s.db.View(func(tx *bolt.Tx) error {
+		mtimes := tx.Bucket(boltMtimesBucket)
+		c := tx.Bucket(boltBlobsBucket).Cursor()
+		for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+			blob := blobInfo{name: string(k[len(prefix):]), size: int64(len(v))}
+			mtime := mtimes.Get(k)
+			if len(mtime) == 8 {
+				blob.modTime = time.Unix(0, int64(binary.BigEndian.Uint64(mtime)))
+			}
+			blobs = append(blobs, blob)
+		}
+		if len(blobs) == 0 {
+			return fmt.Errorf("list %s: %w", dir, os.ErrNotExist)
+		}
+		return nil
+	})
+
+	return
+}
+
+// Close the database, waiting for transactions in progress to finish
+func (s *boltStore) Close() (err error) {
+	return s.db.Close()
+}
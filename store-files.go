@@ -0,0 +1,605 @@
+// Copyright 2020 Blues Inc.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+// The default store, which keeps each target in a folder of the data
+// directory, with its records in one yyyy-mm-dd.json file per day and its
+// blobs as ordinary files.  Once a day has ended its file is compressed to
+// yyyy-mm-dd.json.gz.  A record may still arrive for a day after it has been
+// compressed, recreating its .json file, and so a day's records are those of
+// both files, which are merged when the day is next compacted.
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Suffixes of the files holding a day's records, as written and once compressed
+const (
+	fileRecordsSuffix           = ".json"
+	fileRecordsCompressedSuffix = ".json.gz"
+
+	// The comment in the header of a compressed file giving its line count
+	fileRecordsCountComment = "records=%d"
+)
+
+// The daily-file store
+type fileStore struct {
+	dir string
+}
+
+// Ensure file integrity
+var fileLock sync.RWMutex
+
+// Enumerate a list of the targets that have been used
+func (s *fileStore) ListTargets() (targets []string) {
+
+	// Get a list of all folders in the data directory
+	files, err := os.ReadDir(s.dir)
+	if err != nil {
+		return
+	}
+
+	// Append to list of targets if it's a non-special folder
+	for _, file := range files {
+		if !file.IsDir() {
+			continue
+		}
+		target := file.Name()
+		if strings.HasPrefix(target, ".") {
+			continue
+		}
+		targets = append(targets, target)
+	}
+
+	return
+}
+
+// List the days for which a target has a file of the form yyyy-mm-dd.json or
+// yyyy-mm-dd.json.gz
+func (s *fileStore) RecordDays(target string) (days []string) {
+
+	files, err := os.ReadDir(filepath.Join(s.dir, target))
+	if err != nil {
+		return
+	}
+
+	found := map[string]bool{}
+	for _, file := range files {
+		if file.IsDir() {
+			continue
+		}
+		day, ok := recordsFileDay(file.Name())
+		if !ok {
+			continue
+		}
+		if !found[day] {
+			found[day] = true
+			days = append(days, day)
+		}
+	}
+	sort.Strings(days)
+
+	return
+}
+
+// Get the day whose records are held in a file of a target's folder, if any
+func recordsFileDay(name string) (day string, ok bool) {
+	if strings.HasSuffix(name, fileRecordsSuffix) {
+		day = strings.TrimSuffix(name, fileRecordsSuffix)
+	} else if strings.HasSuffix(name, fileRecordsCompressedSuffix) {
+		day = strings.TrimSuffix(name, fileRecordsCompressedSuffix)
+	} else {
+		return
+	}
+	ok = len(strings.Split(day, "-")) == 3
+	return
+}
+
+// Get the pathname of a day's file, either as written or once compressed
+func (s *fileStore) recordsPath(target string, day string, compressed bool) string {
+	if compressed {
+		return filepath.Join(s.dir, target, day+fileRecordsCompressedSuffix)
+	}
+	return filepath.Join(s.dir, target, day+fileRecordsSuffix)
+}
+
+// Read the contents of a day's files, being the records that have been
+// compressed followed by any appended since.  Should the service have stopped
+// after a compressed file was written but before the file it replaced was
+// removed, the latter is a copy of what the former ends with, and is ignored.
+func (s *fileStore) readDay(target string, day string) (contents []byte, err error) {
+
+	compressed, err := s.readCompressedDay(target, day)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return
+	}
+	missing := err != nil
+
+	contents, err = os.ReadFile(s.recordsPath(target, day, false))
+	if errors.Is(err, os.ErrNotExist) && !missing {
+		return compressed, nil
+	}
+	if err != nil || missing {
+		return
+	}
+	if bytes.HasSuffix(compressed, contents) {
+		return compressed, nil
+	}
+
+	return append(compressed, contents...), nil
+}
+
+// Read a day's compressed file
+func (s *fileStore) readCompressedDay(target string, day string) (contents []byte, err error) {
+
+	f, err := os.Open(s.recordsPath(target, day, true))
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		return
+	}
+	defer zr.Close()
+
+	return io.ReadAll(zr)
+}
+
+// Read the records in a day's file, one per line
+func (s *fileStore) ReadRecords(target string, day string) (records []storedRecord, err error) {
+
+	contents, err := s.readDay(target, day)
+	if err != nil {
+		return
+	}
+
+	for _, line := range bytes.Split(contents, []byte{'\n'}) {
+		if len(line) > 0 {
+			records = append(records, recordParse(line, day))
+		}
+	}
+
+	return
+}
+
+// Count the lines of a day's files.  A compressed file notes in its header the
+// number of lines it holds, so a day that has only been compressed needn't be
+// read at all.
+func (s *fileStore) RecordCount(target string, day string) (count int) {
+
+	_, err := os.Stat(s.recordsPath(target, day, false))
+	if errors.Is(err, os.ErrNotExist) {
+		f, err := os.Open(s.recordsPath(target, day, true))
+		if err != nil {
+			return
+		}
+		zr, err := gzip.NewReader(f)
+		if err == nil {
+			_, err = fmt.Sscanf(zr.Comment, fileRecordsCountComment, &count)
+			zr.Close()
+		}
+		f.Close()
+		if err == nil {
+			return
+		}
+	}
+
+	contents, _ := s.readDay(target, day)
+	return recordsLineCount(contents)
+}
+
+// Count the lines of a day's file, skipping empty ones as ReadRecords does
+func recordsLineCount(contents []byte) (count int) {
+	for _, line := range bytes.Split(contents, []byte{'\n'}) {
+		if len(line) > 0 {
+			count++
+		}
+	}
+	return
+}
+
+// Append a record as a line of a day's file
+func (s *fileStore) AppendRecord(target string, day string, rec storedRecord) (err error) {
+
+	recJSON, err := json.Marshal(rec)
+	if err != nil {
+		return
+	}
+	recJSON = append(recJSON, []byte("\n")...)
+
+	// Exclude compression, which would otherwise lose a record appended just
+	// as the day's file is replaced.  A record that arrives once the file has
+	// been replaced starts a new one, which the next compaction merges.
+	fileLock.Lock()
+	defer fileLock.Unlock()
+
+	err = os.MkdirAll(filepath.Join(s.dir, target), 0777)
+	if err != nil {
+		return
+	}
+	f, err := os.OpenFile(s.recordsPath(target, day, false), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return
+	}
+	_, err = f.Write(recJSON)
+	if err != nil {
+		f.Close()
+		return
+	}
+	return f.Close()
+
+}
+
+// Get the size on disk of a day's files
+func (s *fileStore) RecordBytes(target string, day string) (size int64) {
+	for _, compressed := range []bool{false, true} {
+		info, err := os.Stat(s.recordsPath(target, day, compressed))
+		if err == nil {
+			size += info.Size()
+		}
+	}
+	return
+}
+
+// Delete a day's file, in whichever forms it exists
+func (s *fileStore) PurgeRecords(target string, day string) (err error) {
+	err = os.Remove(s.recordsPath(target, day, false))
+	errCompressed := os.Remove(s.recordsPath(target, day, true))
+	if errCompressed == nil {
+		err = nil
+	}
+	return
+}
+
+// Compress the files of days that have ended
+func (s *fileStore) CompactRecords(target string) {
+
+	today := time.Now().UTC().Format("2006-01-02")
+	for _, day := range s.RecordDays(target) {
+		if day >= today {
+			continue
+		}
+		_, err := os.Stat(s.recordsPath(target, day, false))
+		if err != nil {
+			continue
+		}
+		err = s.compressDay(target, day)
+		if err != nil {
+			fmt.Printf("compress %s %s: %s\n", target, day, err)
+		}
+	}
+
+}
+
+// Replace a day's file with its compressed form, merged with whatever had
+// already been compressed for the day.  The compressed file is written under a
+// temporary name and renamed into place before the original is removed, so
+// that the day's records may be read throughout.
+func (s *fileStore) compressDay(target string, day string) (err error) {
+
+	fileLock.Lock()
+	defer fileLock.Unlock()
+
+	pathname := s.recordsPath(target, day, false)
+	contents, err := s.readDay(target, day)
+	if err != nil {
+		return
+	}
+
+	compressedPathname := s.recordsPath(target, day, true)
+	tempPathname := compressedPathname + ".tmp"
+	f, err := os.OpenFile(tempPathname, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return
+	}
+	zw := gzip.NewWriter(f)
+	zw.Comment = fmt.Sprintf(fileRecordsCountComment, recordsLineCount(contents))
+	_, err = zw.Write(contents)
+	if err == nil {
+		err = zw.Close()
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	f.Close()
+	if err != nil {
+		os.Remove(tempPathname)
+		return
+	}
+
+	err = os.Rename(tempPathname, compressedPathname)
+	if err != nil {
+		os.Remove(tempPathname)
+		return
+	}
+
+	err = os.Remove(pathname)
+	if err != nil {
+		return
+	}
+
+	info, err := os.Stat(compressedPathname)
+	if err == nil {
+		fmt.Printf("compressed %s %s (%d to %d bytes)\n", target, day, len(contents), info.Size())
+	}
+
+	return nil
+}
+
+// Map the name of a blob to the pathname of its file, rejecting names that
+// would escape the data directory
+func (s *fileStore) blobPath(name string) (pathname string, err error) {
+	_, bad := cleanFilename(name)
+	if bad {
+		err = fmt.Errorf("invalid filename: %s", name)
+		return
+	}
+	pathname = filepath.Join(s.dir, name)
+	return
+}
+
+// Write or append to a file, creating its folder if necessary
+func (s *fileStore) PutBlob(name string, contents []byte, append bool) (err error) {
+
+	pathname, err := s.blobPath(name)
+	if err != nil {
+		return
+	}
+
+	c := strings.Split(pathname, "/")
+	if len(c) > 1 {
+		fileLock.Lock()
+		os.MkdirAll(strings.Join(c[0:len(c)-1], "/"), 0777)
+		fileLock.Unlock()
+	}
+
+	fileLock.Lock()
+	defer fileLock.Unlock()
+
+	// A file that isn't appended to is replaced by what is written, where once
+	// writing a shorter file over a longer one left the longer one's tail
+	flags := os.O_CREATE | os.O_WRONLY
+	if append {
+		flags = flags | os.O_APPEND
+	} else {
+		flags = flags | os.O_TRUNC
+	}
+	f, err := os.OpenFile(pathname, flags, 0644)
+	if err == nil {
+		_, err = f.Write(contents)
+		closeErr := f.Close()
+		if err == nil {
+			err = closeErr
+		}
+	}
+
+	return
+}
+
+// Flush a file, and the directory entry that names it, to disk
+func (s *fileStore) SyncBlob(name string) (err error) {
+
+	pathname, err := s.blobPath(name)
+	if err != nil {
+		return
+	}
+
+	fileLock.RLock()
+	defer fileLock.RUnlock()
+
+	for _, p := range []string{pathname, filepath.Dir(pathname)} {
+		var f *os.File
+		f, err = os.Open(p)
+		if err != nil {
+			return
+		}
+		err = f.Sync()
+		f.Close()
+		if err != nil {
+			return
+		}
+	}
+
+	return
+}
+
+// Read a file
+func (s *fileStore) GetBlob(name string) (contents []byte, err error) {
+
+	pathname, err := s.blobPath(name)
+	if err != nil {
+		return
+	}
+
+	fileLock.Lock()
+	contents, err = os.ReadFile(pathname)
+	fileLock.Unlock()
+
+	return
+}
+
+// Get the size and modification time of a file, without opening it
+func (s *fileStore) StatBlob(name string) (info blobInfo, err error) {
+
+	pathname, err := s.blobPath(name)
+	if err != nil {
+		return
+	}
+
+	fi, err := os.Stat(pathname)
+	if err == nil && fi.IsDir() {
+		err = fmt.Errorf("stat %s: %w", name, os.ErrNotExist)
+	}
+	if err != nil {
+		return
+	}
+
+	return blobInfo{name: fi.Name(), size: fi.Size(), modTime: fi.ModTime()}, nil
+}
+
+// Open a file to be read, such as while it's streamed to a client, without
+// holding the lock, so that a slow reader doesn't hold up writers
+func (s *fileStore) OpenBlob(name string) (r io.ReadSeekCloser, info blobInfo, err error) {
+
+	pathname, err := s.blobPath(name)
+	if err != nil {
+		return
+	}
+
+	f, err := os.Open(pathname)
+	if err != nil {
+		return
+	}
+	fi, err := f.Stat()
+	if err == nil && fi.IsDir() {
+		err = fmt.Errorf("open %s: %w", name, os.ErrNotExist)
+	}
+	if err != nil {
+		f.Close()
+		return
+	}
+
+	return f, blobInfo{name: fi.Name(), size: fi.Size(), modTime: fi.ModTime()}, nil
+}
+
+// Delete a file
+func (s *fileStore) DeleteBlob(name string) (err error) {
+
+	pathname, err := s.blobPath(name)
+	if err != nil {
+		return
+	}
+
+	fileLock.Lock()
+	err = os.Remove(pathname)
+	fileLock.Unlock()
+
+	return
+}
+
+// Rename a file, creating the folder into which it is moved if necessary and
+// then flushing that folder so that the rename survives a crash
+func (s *fileStore) RenameBlob(from string, to string) (err error) {
+
+	fromPath, err := s.blobPath(from)
+	if err != nil {
+		return
+	}
+	toPath, err := s.blobPath(to)
+	if err != nil {
+		return
+	}
+
+	fileLock.Lock()
+	defer fileLock.Unlock()
+
+	os.MkdirAll(filepath.Dir(toPath), 0777)
+	err = os.Rename(fromPath, toPath)
+	if err != nil {
+		return
+	}
+
+	for _, p := range []string{filepath.Dir(toPath), filepath.Dir(fromPath)} {
+		var f *os.File
+		f, err = os.Open(p)
+		if err != nil {
+			return
+		}
+		err = f.Sync()
+		f.Close()
+		if err != nil {
+			return
+		}
+	}
+
+	return
+}
+
+// List the files in a folder
+func (s *fileStore) ListBlobs(dir string) (blobs []blobInfo, err error) {
+
+	pathname, err := s.blobPath(dir)
+	if err != nil {
+		return
+	}
+
+	entries, err := os.ReadDir(pathname)
+	if err != nil {
+		return
+	}
+	for _, e := range entries {
+		if e.IsDir() {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			continue
+		}
+		blobs = append(blobs, blobInfo{name: e.Name(), size: info.Size(), modTime: info.ModTime()})
+	}
+
+	return
+}
+
+// List the files within a folder and all those beneath it, named relative to
+// it, leaving out the files holding the records of a target, which are not
+// blobs.  A folder holding no files is treated as missing, as it is by the
+// bolt store, which has no folders of its own.
+func (s *fileStore) ListBlobTree(dir string) (blobs []blobInfo, err error) {
+
+	pathname, err := s.blobPath(dir)
+	if err != nil {
+		return
+	}
+
+	fileLock.RLock()
+	defer fileLock.RUnlock()
+
+	err = filepath.WalkDir(pathname, func(p string, e os.DirEntry, err error) error {
+		if err != nil || e.IsDir() {
+			return err
+		}
+		if p == pathname {
+			return fmt.Errorf("list %s: %w", dir, os.ErrNotExist)
+		}
+		name, err := filepath.Rel(pathname, p)
+		if err != nil {
+			return err
+		}
+		name = filepath.ToSlash(name)
+		_, isRecords := recordsFileDay(e.Name())
+		if isRecords && !strings.Contains(path.Dir(path.Join(dir, name)), "/") {
+			return nil
+		}
+		info, err := e.Info()
+		if err != nil {
+			return nil
+		}
+		blobs = append(blobs, blobInfo{name: name, size: info.Size(), modTime: info.ModTime()})
+		return nil
+	})
+	if err == nil && len(blobs) == 0 {
+		err = fmt.Errorf("list %s: %w", dir, os.ErrNotExist)
+	}
+
+	return
+}
+
+// Close the store, which holds nothing open between operations
+func (s *fileStore) Close() (err error) {
+	return
+}
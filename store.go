@@ -0,0 +1,129 @@
+// Copyright 2020 Blues Inc.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+// Storage of targets' records and uploaded files
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// Store is the interface to the storage of the records posted to targets and
+// of the files (blobs) uploaded into them.  Records are grouped by the UTC day
+// on which they were received, in the form yyyy-mm-dd, so that reads may skip
+// whole days and retention may discard them.  Blobs are named by slash-separated
+// paths whose first component is the target.
+type Store interface {
+
+	// List the targets that have records or blobs
+	ListTargets() (targets []string)
+
+	// List, in sorted order, the days on which a target has records
+	RecordDays(target string) (days []string)
+
+	// Read all records of a target received on a day, oldest first
+	ReadRecords(target string, day string) (records []storedRecord, err error)
+
+	// Append a record to those of a target received on a day
+	AppendRecord(target string, day string, rec storedRecord) (err error)
+
+	// Get the number of bytes used to store the records of a target received on a day
+	RecordBytes(target string, day string) (size int64)
+
+	// Count the records of a target received on a day, without parsing them
+	RecordCount(target string, day string) (count int)
+
+	// Discard all records of a target received on a day
+	PurgeRecords(target string, day string) (err error)
+
+	// Reduce the space taken by the records of a target on days that have ended
+	CompactRecords(target string)
+
+	// Write a blob, or append to it, creating it if necessary
+	PutBlob(name string, contents []byte, append bool) (err error)
+
+	// Ensure that what has been written to a blob is on stable storage
+	SyncBlob(name string) (err error)
+
+	// Read a blob
+	GetBlob(name string) (contents []byte, err error)
+
+	// Get the size and modification time of a blob without reading it
+	StatBlob(name string) (info blobInfo, err error)
+
+	// Open a blob to be read from any position, along with its size and
+	// modification time, which must be closed once read
+	OpenBlob(name string) (r io.ReadSeekCloser, info blobInfo, err error)
+
+	// Rename a blob, replacing any blob of the new name, such that the blob
+	// is found under one name or the other even if the process dies midway.
+	// The rename is on stable storage when this returns without error.
+	RenameBlob(from string, to string) (err error)
+
+	// Delete a blob
+	DeleteBlob(name string) (err error)
+
+	// List the blobs directly within a directory
+	ListBlobs(dir string) (blobs []blobInfo, err error)
+
+	// List the blobs within a directory and all those beneath it, named
+	// relative to the directory, which doesn't exist unless it holds a blob
+	ListBlobTree(dir string) (blobs []blobInfo, err error)
+
+	// Release the store, after which it may no longer be used
+	Close() (err error)
+}
+
+// Information about a blob, as returned by ListBlobs
+type blobInfo struct {
+	name    string
+	size    int64
+	modTime time.Time
+}
+
+// Supported values of the "store" config setting
+const (
+	storeFiles = "files"
+	storeBolt  = "bolt"
+)
+
+// The name, within the data directory, of the database used by the bolt store
+const storeBoltFilename = ".myjson.db"
+
+// The store in use
+var store Store
+
+// Open the store selected by the service config
+func storeOpen() {
+	var err error
+
+	if Config.Store == "" {
+		Config.Store = storeFiles
+	}
+
+	switch Config.Store {
+
+	case storeFiles:
+		store = &fileStore{dir: configDataDirectory}
+
+	case storeBolt:
+		os.MkdirAll(configDataDirectory, 0777)
+		store, err = boltStoreOpen(configDataDirectory + storeBoltFilename)
+		if err != nil {
+			fmt.Printf("can't open store: %s\n", err)
+			os.Exit(-1)
+		}
+
+	default:
+		fmt.Printf("unrecognized store: %s\n", Config.Store)
+		os.Exit(-1)
+
+	}
+
+	fmt.Printf("using %s store\n", Config.Store)
+
+}
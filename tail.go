@@ -5,38 +5,14 @@
 package main
 
 import (
-	"bytes"
 	"encoding/json"
 	"fmt"
-	"os"
-	"path/filepath"
-	"sort"
-	"strings"
 	"time"
 )
 
 // Enumerate a list of the targets that have been used
 func tailTargets() (targets []string) {
-
-	// Get a list of all folders in the data directory
-	files, err := os.ReadDir(configDataDirectory)
-	if err != nil {
-		return
-	}
-
-	// Append to list of targets if it's a non-special folder
-	for _, file := range files {
-		if !file.IsDir() {
-			continue
-		}
-		target := file.Name()
-		if strings.HasPrefix(target, ".") {
-			continue
-		}
-		targets = append(targets, target)
-	}
-
-	return
+	return store.ListTargets()
 }
 
 // Do a tail of the posted results, optionally cleaning results prior to that tail
@@ -47,11 +23,11 @@ func tail(target string, count int, clean bool, pargs *map[string]string) (data
 	if pargs != nil {
 		args = *pargs
 	}
-	bodyText := args["text"] != ""
-	addNewline := args["nl"] != ""
+	of, _ := formatParse(args)
+	where, _ := filterParse(args["where"])
 
-	// Don't allow purge of certain hard-wired targets
-	if target == "health" {
+	// Don't allow purge of targets whose policy forbids it
+	if clean && retentionPolicyFor(target).NeverPurge {
 		clean = false
 	}
 
@@ -63,101 +39,49 @@ func tail(target string, count int, clean bool, pargs *map[string]string) (data
 		count = configMaxPosts
 	}
 
-	// Get the list of files for the target
-	targetDir := filepath.Join(configDataDirectory, target)
-	files, err := os.ReadDir(targetDir)
-	if err != nil {
-		return
-	}
+	// Get the list of days for the target
+	days := store.RecordDays(target)
 
 	// Show that we're reading this
-	if !clean {
+	if !clean && len(days) > 0 {
 		fmt.Printf("tail %s %d\n", target, count)
 	}
 
-	// Append to the list of files
-	var filenames []string
-	for _, file := range files {
-		if file.IsDir() {
-			continue
-		}
-
-		// Only purge files that are of the form yyyy-mm-dd.json
-		name := file.Name()
-		if !strings.HasSuffix(name, ".json") {
-			continue
-		}
-		if len(strings.Split(name, "-")) != 3 {
-			continue
-		}
-
-		// Append the name to the list of files to be deleted
-		filenames = append(filenames, name)
-
-	}
-	if len(filenames) == 0 {
-		return
-	}
-
-	// Sort the filenames
-	sort.Strings(filenames)
-
 	// Start gathering results in most-recent order
-	numFilenames := len(filenames)
-	appended := 0
+	var records []storedRecord
+	numDays := len(days)
 	done := false
-	for i := numFilenames - 1; i >= 0; i = i - 1 {
-		filename := filepath.Join(targetDir, filenames[i])
+	for i := numDays - 1; i >= 0; i = i - 1 {
 
-		// If we're cleaning and  we're done, delete the file
+		// If we're cleaning and  we're done, delete the day
 		if clean && done {
-			fmt.Printf("purging %s %s\n", target, filenames[i])
-			os.Remove(filename)
+			fmt.Printf("purging %s %s\n", target, days[i])
+			store.PurgeRecords(target, days[i])
 			continue
 		}
 
-		// Open the file
-		contents, err := os.ReadFile(filename)
-		if err != nil {
-			fmt.Printf("can't read %s: %s\n", filenames[i], err)
-			continue
-		}
+		// Read the records for the day
+		dayRecords := recordReadDay(target, days[i])
 
-		// Split the file into the json parts
-		arrayJSON := bytes.Split(contents, []byte{'\n'})
-		arrayLen := len(arrayJSON)
-		if arrayLen == 0 {
-			continue
-		}
-
-		// Append to the data, noting if we're done
-		for j := arrayLen - 1; j >= 0 && !done; j = j - 1 {
-			if len(arrayJSON[j]) > 0 {
-				thisdata := arrayJSON[j]
-				// Do special processing of data if requested
-				if bodyText {
-					thisdata = extractBodyText(thisdata)
-				}
-				// Place data at the beginning
-				if len(data) == 0 {
-					data = thisdata
-				} else {
-					thisdata = append(thisdata, []byte("\n")...)
-					if addNewline {
-						thisdata = append(thisdata, []byte("\n")...)
-					}
-					data = append(thisdata, data...)
-				}
-				// Next
-				appended = appended + 1
-				if appended >= count {
-					done = true
-				}
+		// Append to the results, noting if we're done
+		for j := len(dayRecords) - 1; j >= 0 && !done; j = j - 1 {
+			if !where.match(dayRecords[j].Payload) {
+				continue
+			}
+			records = append(records, dayRecords[j])
+			if len(records) >= count {
+				done = true
 			}
 		}
 
 	}
 
+	// Render the results in chronological order
+	for i, j := 0, len(records)-1; i < j; i, j = i+1, j-1 {
+		records[i], records[j] = records[j], records[i]
+	}
+	data = of.render(records)
+
 	// Done
 	return
 
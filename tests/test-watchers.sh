@@ -0,0 +1,26 @@
+#!/bin/bash
+# Load test of watch fan-out: start $1 watchers spread across $2 targets,
+# post $3 records to the first target, and report how long the posts took
+# and how many events reached its watchers.  The fan-out itself, without
+# HTTP, is measured by 'go test -bench Watchers'.
+URL=${URL:-http://localhost}
+WATCHERS=${1:-1000}
+TARGETS=${2:-100}
+POSTS=${3:-100}
+OUT=$(mktemp -d)
+for (( i=0; i<WATCHERS; i++ ))
+  do
+	curl -s -N -H "Accept: text/event-stream" "$URL/load-$((i % TARGETS))" > $OUT/$i &
+  done
+sleep 2
+START=$(date +%s%N)
+for (( i=1; i<=POSTS; i++ ))
+  do
+	curl -s -o /dev/null -X POST "$URL/load-0" -d "{\"i\":$i}"
+  done
+END=$(date +%s%N)
+sleep 1
+kill $(jobs -p) 2>/dev/null
+echo "$POSTS posts in $(( (END - START) / 1000000 ))ms"
+echo "$(cat $OUT/* | grep -c '^data:') events delivered, expected $(( POSTS * ((WATCHERS + TARGETS - 1) / TARGETS) ))"
+rm -rf $OUT
@@ -0,0 +1,169 @@
+// Copyright 2020 Blues Inc.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+// HTTPS, using either a static certificate or one obtained and renewed
+// automatically from an ACME certificate authority such as Let's Encrypt
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// The port on which HTTPS is served, unless configured otherwise
+const configTLSPort = ":443"
+
+// Where certificates obtained by ACME are cached, within the home directory.
+// The cache holds private keys, and so is kept beside the config rather than
+// in the data directory, whose files are served.
+const configTLSCacheDirectory = "/config/autocert"
+
+// Where the cache was kept before, from which it is moved on startup
+const configTLSCacheDirectoryLegacy = ".autocert"
+
+// TLSConfig configures HTTPS.  It is enabled by either a certificate and key
+// file or a list of hosts for which certificates are obtained automatically.
+type TLSConfig struct {
+
+	// The port on which to serve HTTPS, such as ":443"
+	Port string `json:"port,omitempty"`
+
+	// PEM files holding a static certificate (with its chain) and its key
+	CertFile string `json:"cert_file,omitempty"`
+	KeyFile  string `json:"key_file,omitempty"`
+
+	// The host names for which certificates are obtained by ACME, along with
+	// the contact address given to the certificate authority and, if not
+	// Let's Encrypt, the URL of its directory
+	ACMEHosts     []string `json:"acme_hosts,omitempty"`
+	ACMEEmail     string   `json:"acme_email,omitempty"`
+	ACMEDirectory string   `json:"acme_directory,omitempty"`
+
+	// Redirect plain HTTP requests to HTTPS
+	RedirectHTTP bool `json:"redirect_http,omitempty"`
+}
+
+// Determine whether HTTPS is configured
+func (c TLSConfig) enabled() bool {
+	return c.CertFile != "" || len(c.ACMEHosts) > 0
+}
+
+// Get the port on which HTTPS is served
+func (c TLSConfig) port() string {
+	if c.Port == "" {
+		return configTLSPort
+	}
+	return c.Port
+}
+
+// Start serving HTTPS with the given handler, returning the handler with
+// which plain HTTP should be served instead, which redirects to HTTPS if so
+// configured and, with ACME, answers the certificate authority's challenges
+func tlsStart(handler http.Handler) (plainHandler http.Handler, err error) {
+
+	plainHandler = handler
+	c := Config.TLS
+	if !c.enabled() {
+		return
+	}
+	if c.CertFile != "" && len(c.ACMEHosts) > 0 {
+		err = fmt.Errorf("tls: configure either a certificate file or ACME hosts, not both")
+		return
+	}
+
+	if c.RedirectHTTP {
+		plainHandler = http.HandlerFunc(tlsRedirect)
+	}
+
+	server := &http.Server{Addr: c.port(), Handler: handler, BaseContext: func(net.Listener) context.Context { return shutdownContext }}
+	serving := ""
+
+	// A static certificate is loaded once, here, so that a bad one is
+	// reported at startup rather than on the first connection
+	if c.CertFile != "" {
+		var cert tls.Certificate
+		cert, err = tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+		if err != nil {
+			err = fmt.Errorf("tls: can't load certificate: %s", err)
+			return
+		}
+		server.TLSConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+		serving = "with certificate " + c.CertFile
+	}
+
+	// Certificates obtained by ACME are cached so that they survive restarts,
+	// which avoids the certificate authority's rate limits
+	if len(c.ACMEHosts) > 0 {
+		homedir, _ := os.UserHomeDir()
+		cacheDir := homedir + configTLSCacheDirectory
+		legacyDir := configDataDirectory + configTLSCacheDirectoryLegacy
+		if _, err := os.Stat(cacheDir); errors.Is(err, os.ErrNotExist) {
+			if os.Rename(legacyDir, cacheDir) == nil {
+				fmt.Printf("tls: moved certificate cache from %s to %s\n", legacyDir, cacheDir)
+			}
+		}
+		err = os.MkdirAll(cacheDir, 0700)
+		if err != nil {
+			err = fmt.Errorf("tls: can't create certificate cache: %s", err)
+			return
+		}
+		manager := &autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			Cache:      autocert.DirCache(cacheDir),
+			HostPolicy: autocert.HostWhitelist(c.ACMEHosts...),
+			Email:      c.ACMEEmail,
+		}
+		if c.ACMEDirectory != "" {
+			manager.Client = &acme.Client{DirectoryURL: c.ACMEDirectory}
+		}
+		server.TLSConfig = manager.TLSConfig()
+		plainHandler = manager.HTTPHandler(plainHandler)
+		serving = "for " + strings.Join(c.ACMEHosts, ",")
+	}
+
+	// The port is bound here, so that a port that can't be bound is reported
+	// at startup rather than leaving the service running without HTTPS
+	listener, err := net.Listen("tcp", c.port())
+	if err != nil {
+		err = fmt.Errorf("tls: %s", err)
+		return
+	}
+	fmt.Printf("Now handling inbound HTTPS on %s %s\n", c.port(), serving)
+
+	shutdownRegister(server)
+	go func() {
+		err := server.ServeTLS(listener, "", "")
+		if err != nil && err != http.ErrServerClosed {
+			fmt.Printf("https: %s\n", err)
+		}
+	}()
+
+	return
+
+}
+
+// Redirect a plain HTTP request to the same URL over HTTPS.  The redirect is
+// permanent and preserves the method, so that a device posting to the plain
+// URL may follow it with its body intact.
+func tlsRedirect(httpRsp http.ResponseWriter, httpReq *http.Request) {
+	host := httpReq.Host
+	h, _, err := net.SplitHostPort(host)
+	if err == nil {
+		host = h
+	}
+	_, port, err := net.SplitHostPort(Config.TLS.port())
+	if err == nil && port != "443" && port != "https" {
+		host = net.JoinHostPort(host, port)
+	}
+	http.Redirect(httpRsp, httpReq, "https://"+host+httpReq.URL.RequestURI(), http.StatusPermanentRedirect)
+}
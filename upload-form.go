@@ -0,0 +1,180 @@
+// Copyright 2020 Blues Inc.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+// Uploads from browsers, as multipart forms holding any number of files, and
+// the page from which files may be chosen or dropped to be uploaded that way
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"html"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+)
+
+// The result of the upload of one of the files of a form
+type uploadFormItem struct {
+	uploadResult
+	Name  string `json:"name"`
+	Error string `json:"error,omitempty"`
+}
+
+// The result of the upload of the files of a form
+type uploadFormResult struct {
+	Uploaded int              `json:"uploaded"`
+	Failed   int              `json:"failed"`
+	Results  []uploadFormItem `json:"results"`
+}
+
+// Determine whether a request is a multipart form, returning its boundary
+func uploadFormBoundary(httpReq *http.Request) (boundary string, ok bool) {
+	mediaType, params, err := mime.ParseMediaType(httpReq.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/form-data" || params["boundary"] == "" {
+		return
+	}
+	return params["boundary"], true
+}
+
+// Upload the files of a multipart form into a folder of a target, whose path
+// has been cleaned, each named as it was on the client, and each written and
+// flushed to disk before the reply, which gives the result for each file.
+// Fields of the form that aren't files are ignored.  The reply's status is 200
+// unless no file was uploaded.  The request is charged against the rate limits
+// for each file.
+func uploadForm(httpRsp http.ResponseWriter, httpReq *http.Request, args map[string]string, dir string, boundary string, body []byte) {
+
+	files := 0
+	mr := multipart.NewReader(bytes.NewReader(body), boundary)
+	for {
+		part, err := mr.NextPart()
+		if err != nil {
+			break
+		}
+		if part.FileName() != "" {
+			files++
+		}
+		part.Close()
+	}
+	if !rateCheck(httpRsp, httpReq, args, dir, files) {
+		return
+	}
+
+	result := uploadFormResult{Results: []uploadFormItem{}}
+	failedStatus := 0
+
+	mr = multipart.NewReader(bytes.NewReader(body), boundary)
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			http.Error(httpRsp, "invalid form: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if part.FileName() == "" {
+			part.Close()
+			continue
+		}
+
+		// Only the last element of the name is used, so that a client can't
+		// place a file anywhere but in the folder to which the form was posted
+		name := path.Base(strings.ReplaceAll(part.FileName(), "\\", "/"))
+		item := uploadFormItem{Name: name}
+		contents, err := io.ReadAll(part)
+		part.Close()
+		status := http.StatusBadRequest
+		if err == nil {
+			item.uploadResult, status, err = uploadStore(dir+"/"+name, false, contents)
+		}
+		if err != nil {
+			item.Error = err.Error()
+			result.Failed++
+			if failedStatus == 0 {
+				failedStatus = status
+			}
+		} else {
+			result.Uploaded++
+		}
+		result.Results = append(result.Results, item)
+	}
+
+	status := http.StatusOK
+	if result.Uploaded == 0 {
+		if result.Failed == 0 {
+			http.Error(httpRsp, "no files in form", http.StatusBadRequest)
+			return
+		}
+		status = failedStatus
+	}
+
+	resultJSON, _ := json.MarshalIndent(result, "", "    ")
+	httpRsp.Header().Set("Content-Type", "application/json")
+	httpRsp.WriteHeader(status)
+	httpRsp.Write(resultJSON)
+
+}
+
+// The page from which files may be uploaded to a folder of a target.  The
+// page's own query, which may carry a key, is passed along when posting.
+const uploadPageHTML = `<!DOCTYPE html>
+<html><head><meta charset="utf-8"><title>Upload to %[1]s</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+#drop { border: 2px dashed #888; border-radius: 8px; padding: 3em; text-align: center; color: #555; }
+#drop.over { border-color: #06c; background: #eef5ff; }
+#log div { margin: 0.25em 0; }
+.failed { color: #c00; }
+</style></head><body>
+<h1>Upload to %[1]s</h1>
+<div id="drop">Drop files here, or <input type="file" id="pick" multiple></div>
+<div id="log"></div>
+<p><a href="%[2]s?list=html">Files in %[1]s</a></p>
+<script>
+const drop = document.getElementById("drop");
+const log = document.getElementById("log");
+const query = new URLSearchParams(location.search);
+const key = query.get("key");
+function upload(files) {
+	if (!files.length) return;
+	const form = new FormData();
+	for (const f of files) form.append("file", f, f.name);
+	const line = document.createElement("div");
+	line.textContent = "Uploading " + files.length + " file(s)...";
+	log.prepend(line);
+	fetch("%[2]s" + (key ? "?key=" + encodeURIComponent(key) : ""), {method: "POST", body: form})
+		.then(rsp => rsp.text().then(text => {
+			let result;
+			try { result = JSON.parse(text); } catch (e) { throw new Error(rsp.status + " " + text); }
+			line.textContent = "";
+			for (const r of result.results) {
+				const d = document.createElement("div");
+				d.textContent = r.error ? r.name + ": " + r.error : r.name + ": " + r.size + " bytes, sha256 " + r.sha256;
+				if (r.error) d.className = "failed";
+				line.append(d);
+			}
+		}))
+		.catch(err => { line.textContent = "Upload failed: " + err.message; line.className = "failed"; });
+}
+drop.addEventListener("dragover", e => { e.preventDefault(); drop.classList.add("over"); });
+drop.addEventListener("dragleave", () => drop.classList.remove("over"));
+drop.addEventListener("drop", e => { e.preventDefault(); drop.classList.remove("over"); upload(e.dataTransfer.files); });
+document.getElementById("pick").addEventListener("change", e => { upload(e.target.files); e.target.value = ""; });
+</script>
+</body></html>
+`
+
+// Serve the upload page of a folder of a target, whose path has been cleaned
+func uploadPage(httpRsp http.ResponseWriter, dir string) {
+	link := (&url.URL{Path: "/" + dir + "/"}).String()
+	httpRsp.Header().Set("Content-Type", "text/html; charset=utf-8")
+	fmt.Fprintf(httpRsp, uploadPageHTML, html.EscapeString("/"+dir+"/"), html.EscapeString(link))
+}
@@ -0,0 +1,343 @@
+// Copyright 2020 Blues Inc.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+// Resumable uploads, in which a file is sent in chunks, each written at the
+// offset the client believes has been committed so far.  A chunk sent again
+// after its acknowledgement was lost is refused rather than appended twice,
+// and the client is told the committed length so that it may carry on from
+// there.  The chunks are staged alongside the target's files until the upload
+// is finished, at which point the whole is checked against the SHA-256 the
+// client computed and renamed into place.  The hash is kept up to date as
+// each chunk is committed, so that finishing an upload needn't read it back.
+package main
+
+import (
+	"crypto/sha256"
+	"encoding"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// The folder, within a target, in which uploads are staged
+const uploadsDir = ".uploads"
+
+// How long an upload may go without a chunk before it is abandoned
+const configUploadIdle = 24 * time.Hour
+
+// An upload in progress
+type uploadSession struct {
+	ID      string `json:"id"`
+	File    string `json:"file"`
+	Size    int64  `json:"size,omitempty"`
+	Created string `json:"created"`
+
+	// The number of bytes committed, which is the offset at which the next
+	// chunk must be written.  This is the size of what has been staged, and
+	// so isn't stored with the rest of the session.
+	Offset int64 `json:"offset"`
+}
+
+// An upload as it is stored, along with the state of the hash of the bytes
+// staged for it.  The state is saved after each chunk is on disk, so it may
+// cover fewer bytes than are staged if the service stopped in between, but
+// never more.
+type uploadStored struct {
+	uploadSession
+	Hash   []byte `json:"hash,omitempty"`
+	Hashed int64  `json:"hashed"`
+}
+
+// Errors that a client may act upon
+var (
+	errUploadNotFound   = errors.New("upload not found")
+	errUploadOffset     = errors.New("chunk is not at the committed offset")
+	errUploadTooLarge   = errors.New("chunk would exceed the declared size")
+	errUploadIncomplete = errors.New("upload is shorter than the declared size")
+	errUploadChecksum   = errors.New("upload does not match its checksum")
+)
+
+// Uploads are staged and finished one chunk at a time
+var uploadsLock sync.Mutex
+
+// The blob in which an upload's chunks are staged, and the one describing it
+func uploadDataName(target string, id string) string {
+	return target + "/" + uploadsDir + "/" + id
+}
+func uploadSessionName(target string, id string) string {
+	return target + "/" + uploadsDir + "/" + id + ".json"
+}
+
+// Get the size of a blob, which must exist
+func blobSize(name string) (size int64, err error) {
+	info, err := store.StatBlob(name)
+	return info.size, err
+}
+
+// Begin an upload of a file to a target, optionally declaring its size
+func uploadCreate(target string, file string, size int64) (session uploadSession, err error) {
+
+	_, bad := cleanFilename(target + "/" + file)
+	if bad || reservedFilename(file) || file == "" || strings.HasSuffix(file, "/") {
+		err = fmt.Errorf("invalid filename: %s", file)
+		return
+	}
+	if size < 0 {
+		err = fmt.Errorf("invalid size: %d", size)
+		return
+	}
+
+	session = uploadSession{ID: uuid.New().String(), File: file, Size: size, Created: time.Now().UTC().Format(time.RFC3339)}
+
+	uploadsLock.Lock()
+	defer uploadsLock.Unlock()
+	err = store.PutBlob(uploadDataName(target, session.ID), []byte{}, false)
+	if err == nil {
+		err = uploadSave(target, uploadStored{uploadSession: session})
+	}
+	if err != nil {
+		return
+	}
+
+	fmt.Printf("upload %s: %s/%s begun\n", session.ID, target, file)
+	return
+
+}
+
+// Get an upload, along with the number of bytes committed, with the lock held
+func uploadLoad(target string, id string) (stored uploadStored, err error) {
+
+	_, err = uuid.Parse(id)
+	if err != nil {
+		err = errUploadNotFound
+		return
+	}
+	sessionJSON, err := store.GetBlob(uploadSessionName(target, id))
+	if err != nil {
+		err = errUploadNotFound
+		return
+	}
+	err = json.Unmarshal(sessionJSON, &stored)
+	if err != nil {
+		return
+	}
+	stored.Offset, err = blobSize(uploadDataName(target, id))
+	if err != nil {
+		err = errUploadNotFound
+	}
+	return
+
+}
+
+// Save the description of an upload, with the lock held
+func uploadSave(target string, stored uploadStored) (err error) {
+	sessionJSON, err := json.Marshal(stored)
+	if err != nil {
+		return
+	}
+	return store.PutBlob(uploadSessionName(target, stored.ID), sessionJSON, false)
+}
+
+// Get the hash of an upload as it stood when its state was last saved, and the
+// number of bytes it covers
+func uploadHash(stored uploadStored) (h hash.Hash, hashed int64, err error) {
+	h = sha256.New()
+	if len(stored.Hash) == 0 {
+		return
+	}
+	err = h.(encoding.BinaryUnmarshaler).UnmarshalBinary(stored.Hash)
+	if err != nil {
+		return
+	}
+	return h, stored.Hashed, nil
+}
+
+// Get an upload, so that a client may learn where to resume it
+func uploadGet(target string, id string) (session uploadSession, err error) {
+	uploadsLock.Lock()
+	defer uploadsLock.Unlock()
+	stored, err := uploadLoad(target, id)
+	return stored.uploadSession, err
+}
+
+// Write a chunk of an upload at an offset, which must be the number of bytes
+// committed so far.  The chunk is on disk when this returns without error.
+// Whether or not it succeeds, the session returned carries the offset at which
+// the next chunk must be written.
+func uploadChunk(target string, id string, offset int64, chunk []byte) (session uploadSession, err error) {
+
+	uploadsLock.Lock()
+	defer uploadsLock.Unlock()
+
+	stored, err := uploadLoad(target, id)
+	session = stored.uploadSession
+	if err != nil {
+		return
+	}
+	if offset != session.Offset {
+		err = errUploadOffset
+		return
+	}
+	if session.Size > 0 && offset+int64(len(chunk)) > session.Size {
+		err = errUploadTooLarge
+		return
+	}
+
+	name := uploadDataName(target, id)
+	err = store.PutBlob(name, chunk, true)
+	if err == nil {
+		err = store.SyncBlob(name)
+	}
+	if err != nil {
+		// Part of the chunk may have been written, so find out how much
+		session.Offset, _ = blobSize(name)
+		return
+	}
+	session.Offset += int64(len(chunk))
+
+	// Carry the hash forward over the chunk, unless it had fallen behind what
+	// was staged, in which case it is caught up when the upload is finished
+	h, hashed, err := uploadHash(stored)
+	if err != nil || hashed != offset {
+		err = nil
+		return
+	}
+	h.Write(chunk)
+	stored.Hash, err = h.(encoding.BinaryMarshaler).MarshalBinary()
+	if err == nil {
+		stored.Hashed = session.Offset
+		err = uploadSave(target, stored)
+	}
+	if err != nil {
+		fmt.Printf("upload %s: can't save hash: %s\n", id, err)
+		err = nil
+	}
+
+	return
+
+}
+
+// Finish an upload, verifying it against the SHA-256 given by the client and
+// then renaming it into place as the file it was uploaded as.  An upload that
+// doesn't match its checksum is left as it is, so that the client may learn
+// how much was committed and decide whether to abandon it.
+func uploadFinish(target string, id string, checksum string) (result uploadResult, err error) {
+
+	uploadsLock.Lock()
+	defer uploadsLock.Unlock()
+
+	stored, err := uploadLoad(target, id)
+	if err != nil {
+		return
+	}
+	session := stored.uploadSession
+	if session.Size > 0 && session.Offset != session.Size {
+		err = errUploadIncomplete
+		return
+	}
+
+	// Hash whatever was staged after the hash was last saved
+	name := uploadDataName(target, id)
+	h, hashed, err := uploadHash(stored)
+	if err != nil {
+		return
+	}
+	if hashed != session.Offset {
+		var r io.ReadSeekCloser
+		r, _, err = store.OpenBlob(name)
+		if err != nil {
+			return
+		}
+		_, err = r.Seek(hashed, io.SeekStart)
+		if err == nil {
+			_, err = io.Copy(h, r)
+		}
+		r.Close()
+		if err != nil {
+			return
+		}
+	}
+	sum := hex.EncodeToString(h.Sum(nil))
+	if !strings.EqualFold(checksum, sum) {
+		err = errUploadChecksum
+		return
+	}
+
+	filename := target + "/" + session.File
+	err = store.RenameBlob(name, filename)
+	if err != nil {
+		return
+	}
+	store.DeleteBlob(uploadSessionName(target, id))
+
+	fmt.Printf("upload %s: %s finished (%d bytes)\n", id, filename, session.Offset)
+	result = uploadResult{File: filename, Written: int(session.Offset), Size: session.Offset, SHA256: sum}
+	return
+
+}
+
+// Abandon an upload
+func uploadAbort(target string, id string) (err error) {
+
+	uploadsLock.Lock()
+	defer uploadsLock.Unlock()
+
+	_, err = uploadLoad(target, id)
+	if err != nil {
+		return
+	}
+	uploadDelete(target, id)
+	fmt.Printf("upload %s: abandoned\n", id)
+	return
+
+}
+
+// Delete what is staged for an upload, with the lock held
+func uploadDelete(target string, id string) {
+	store.DeleteBlob(uploadDataName(target, id))
+	store.DeleteBlob(uploadSessionName(target, id))
+}
+
+// Abandon uploads to which nothing has been written for a while
+func uploadPurgeIdle() {
+
+	uploadsLock.Lock()
+	defer uploadsLock.Unlock()
+
+	for _, target := range store.ListTargets() {
+		blobs, err := store.ListBlobs(target + "/" + uploadsDir)
+		if err != nil {
+			continue
+		}
+		staged := map[string]bool{}
+		for _, blob := range blobs {
+			staged[blob.name] = true
+		}
+		for _, blob := range blobs {
+			if time.Since(blob.modTime) < configUploadIdle {
+				continue
+			}
+			// A description without anything staged is left behind when the
+			// service stops just after an upload is renamed into place
+			id := blob.name
+			if strings.HasSuffix(id, ".json") {
+				id = strings.TrimSuffix(id, ".json")
+				if staged[id] {
+					continue
+				}
+			}
+			fmt.Printf("upload %s: idle since %s, abandoned\n", id, blob.modTime.UTC().Format(time.RFC3339))
+			uploadDelete(target, id)
+		}
+	}
+
+}
@@ -0,0 +1,81 @@
+// Copyright 2020 Blues Inc.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+// Newline-delimited JSON framing of the plain watch stream, in which every
+// line is a compact JSON object whose type says what it is
+package main
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// Framings of the plain watch stream
+const (
+	framingText   = "text"
+	framingNDJSON = "ndjson"
+)
+
+// The first line of the stream, describing what is watched
+type ndjsonBanner struct {
+	Type     string   `json:"type"`
+	Time     string   `json:"time"`
+	Targets  []string `json:"targets"`
+	Patterns []string `json:"patterns,omitempty"`
+}
+
+// A record posted to a watched target
+type ndjsonEvent struct {
+	Type     string          `json:"type"`
+	Target   string          `json:"target"`
+	Seq      int64           `json:"seq"`
+	Received string          `json:"received"`
+	Payload  json.RawMessage `json:"payload"`
+}
+
+// Sent in place of events that were dropped because the client fell behind
+type ndjsonDropped struct {
+	Type    string `json:"type"`
+	Time    string `json:"time"`
+	Dropped int    `json:"dropped"`
+}
+
+// Sent when there has been nothing else to send for a while, and, with the
+// type "shutdown", as the last line before the service shuts down
+type ndjsonHeartbeat struct {
+	Type string `json:"type"`
+	Time string `json:"time"`
+}
+
+// Marshal a frame as a line
+func ndjsonLine(frame interface{}) []byte {
+	line, _ := json.Marshal(frame)
+	return append(line, '\n')
+}
+
+// Format the banner of a watch
+func ndjsonBannerLine(opts watchOptions) []byte {
+	return ndjsonLine(ndjsonBanner{Type: "banner", Time: time.Now().UTC().Format(time.RFC3339), Targets: append([]string{}, opts.targets...), Patterns: opts.patterns})
+}
+
+// Format a heartbeat
+func ndjsonHeartbeatLine() []byte {
+	return ndjsonLine(ndjsonHeartbeat{Type: "heartbeat", Time: time.Now().UTC().Format(time.RFC3339)})
+}
+
+// Format events, one per line
+func ndjsonEventLines(events []watchEvent) (data []byte) {
+	for _, evt := range events {
+		if evt.shutdown {
+			data = append(data, ndjsonLine(ndjsonHeartbeat{Type: "shutdown", Time: time.Now().UTC().Format(time.RFC3339)})...)
+			continue
+		}
+		if evt.dropped > 0 {
+			data = append(data, ndjsonLine(ndjsonDropped{Type: "dropped", Time: time.Now().UTC().Format(time.RFC3339), Dropped: evt.dropped})...)
+			continue
+		}
+		data = append(data, ndjsonLine(ndjsonEvent{Type: "event", Target: evt.target, Seq: evt.id, Received: evt.received, Payload: evt.data})...)
+	}
+	return
+}
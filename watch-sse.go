@@ -0,0 +1,93 @@
+// Copyright 2020 Blues Inc.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+// Server-Sent Events transport for watching a target
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// Watch as a text/event-stream, beginning at the given cursor, if any
+func watchEventStream(httpRsp http.ResponseWriter, httpReq *http.Request, opts watchOptions) {
+
+	// Without the ability to flush there is no way to stream events
+	f, ok := httpRsp.(http.Flusher)
+	if !ok {
+		http.Error(httpRsp, "streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	fmt.Printf("watch %s (sse)\n", opts.name())
+
+	// Disable caching and proxy buffering, both of which defeat live delivery
+	httpRsp.Header().Set("Content-Type", "text/event-stream")
+	httpRsp.Header().Set("Cache-Control", "no-cache")
+	httpRsp.Header().Set("X-Accel-Buffering", "no")
+
+	// Begin, with a comment line that EventSource ignores
+	data := []byte(": " + time.Now().UTC().Format("2006-01-02T15:04:05Z") + " watching " + opts.name() + "\n\n")
+	httpRsp.Write(data)
+
+	// Generate a unique watcher ID
+	watcherID := watcherCreate(opts)
+
+	// Data watching loop, using the same heartbeat interval as the plain stream,
+	// and ending as soon as the client goes away
+	for {
+		f.Flush()
+
+		events, err := watcherGet(httpReq.Context(), watcherID, 16*time.Second)
+		if err != nil && !watcherFinal(err) {
+			break
+		}
+		final := watcherFinal(err)
+		data = nil
+		for _, evt := range events {
+			data = append(data, sseEvent(evt, opts)...)
+		}
+		if len(data) == 0 {
+			data = []byte(": " + time.Now().UTC().Format("2006-01-02T15:04:05Z") + " idle\n\n")
+		}
+
+		_, err = httpRsp.Write(data)
+		if err != nil || final {
+			break
+		}
+
+	}
+
+	// Done
+	watcherDelete(watcherID)
+
+}
+
+// Format a single watch event as an SSE message.  Records stored before they
+// were numbered have no ID, and so leave the client's last event ID alone, as
+// do the records of watches of several targets, whose numbers are unrelated.
+func sseEvent(evt watchEvent, opts watchOptions) []byte {
+	var b bytes.Buffer
+	if evt.shutdown {
+		fmt.Fprintf(&b, "event: shutdown\ndata: {\"time\":\"%s\"}\n\n", time.Now().UTC().Format("2006-01-02T15:04:05Z"))
+		return b.Bytes()
+	}
+	if evt.dropped > 0 {
+		fmt.Fprintf(&b, "event: dropped\ndata: {\"dropped\":%d}\n\n", evt.dropped)
+		return b.Bytes()
+	}
+	if evt.id > 0 && !opts.multi() {
+		fmt.Fprintf(&b, "id: %d\n", evt.id)
+	}
+	b.WriteString("event: post\n")
+	for _, line := range bytes.Split(bytes.TrimSuffix(evt.content(opts), []byte("\n")), []byte("\n")) {
+		b.WriteString("data: ")
+		b.Write(line)
+		b.WriteString("\n")
+	}
+	b.WriteString("\n")
+	return b.Bytes()
+}
@@ -0,0 +1,102 @@
+// Copyright 2020 Blues Inc.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+// WebSocket transport for watching a target
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+// The message sent to websocket clients for each event.  Because websockets
+// have no equivalent of the SSE id field, the record's sequence number and
+// receive time are always carried in the message, as is its target if more
+// than one is watched.
+type wsMessage struct {
+	Target   string          `json:"target,omitempty"`
+	ID       int64           `json:"id,omitempty"`
+	Received string          `json:"received,omitempty"`
+	Data     json.RawMessage `json:"data,omitempty"`
+	Idle     string          `json:"idle,omitempty"`
+	Dropped  int             `json:"dropped,omitempty"`
+	Shutdown string          `json:"shutdown,omitempty"`
+}
+
+// Watch over a websocket, beginning at the given cursor, if any
+func watchWebSocket(httpRsp http.ResponseWriter, httpReq *http.Request, opts watchOptions) {
+
+	fmt.Printf("watch %s (websocket)\n", opts.name())
+
+	// Note that we use a Server rather than a Handler so that, as with the
+	// other transports, browser pages on any origin may subscribe
+	server := websocket.Server{Handler: func(ws *websocket.Conn) {
+
+		// Drain (and ignore) anything the client sends, so that we notice
+		// immediately when it closes the connection, which once hijacked
+		// from the HTTP server isn't otherwise noticed
+		ctx, cancel := context.WithCancel(httpReq.Context())
+		defer cancel()
+		go func() {
+			io.Copy(io.Discard, ws)
+			cancel()
+		}()
+
+		// Generate a unique watcher ID
+		watcherID := watcherCreate(opts)
+
+		// Data watching loop
+		for {
+
+			events, err := watcherGet(ctx, watcherID, 16*time.Second)
+			if err != nil && !watcherFinal(err) {
+				break
+			}
+			final := watcherFinal(err)
+
+			messages := []wsMessage{}
+			for _, evt := range events {
+				if evt.shutdown {
+					messages = append(messages, wsMessage{Shutdown: time.Now().UTC().Format("2006-01-02T15:04:05Z")})
+					continue
+				}
+				if evt.dropped > 0 {
+					messages = append(messages, wsMessage{Dropped: evt.dropped})
+					continue
+				}
+				msg := wsMessage{ID: evt.id, Received: evt.received, Data: evt.data}
+				if opts.multi() {
+					msg.Target = evt.target
+				}
+				messages = append(messages, msg)
+			}
+			if len(messages) == 0 {
+				messages = append(messages, wsMessage{Idle: time.Now().UTC().Format("2006-01-02T15:04:05Z")})
+			}
+			for _, msg := range messages {
+				err = websocket.JSON.Send(ws, msg)
+				if err != nil {
+					break
+				}
+			}
+			if err != nil || final {
+				break
+			}
+
+		}
+
+		// Done
+		watcherDelete(watcherID)
+		ws.Close()
+
+	}}
+	server.ServeHTTP(httpRsp, httpReq)
+
+}
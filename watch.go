@@ -5,25 +5,62 @@
 package main
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
 	"net/http"
+	"strconv"
+	"strings"
 	"time"
 )
 
 // Watch a target, "live"
-func watch(httpRsp http.ResponseWriter, httpReq *http.Request, target string) {
+func watch(httpRsp http.ResponseWriter, httpReq *http.Request, target string, args map[string]string) {
 
-	fmt.Printf("watch %s\n", target)
+	// Determine where in the target's history the client wants to begin
+	opts, err := watchParseOptions(httpReq, args)
+	if err != nil {
+		http.Error(httpRsp, err.Error(), http.StatusBadRequest)
+		return
+	}
+	opts.targets = []string{target}
+
+	watchStart(httpRsp, httpReq, opts)
+
+}
+
+// Watch the targets of a watch using whichever transport the client negotiated
+func watchStart(httpRsp http.ResponseWriter, httpReq *http.Request, opts watchOptions) {
+
+	// Browsers and JS clients negotiate structured transports
+	if strings.EqualFold(httpReq.Header.Get("Upgrade"), "websocket") {
+		watchWebSocket(httpRsp, httpReq, opts)
+		return
+	}
+	if strings.Contains(httpReq.Header.Get("Accept"), "text/event-stream") {
+		watchEventStream(httpRsp, httpReq, opts)
+		return
+	}
+
+	fmt.Printf("watch %s\n", opts.name())
 
 	// Browser clients buffer output before display UNLESS this is the content type
-	httpRsp.Header().Set("Content-Type", "application/json")
+	ndjson := opts.framing == framingNDJSON
+	if ndjson {
+		httpRsp.Header().Set("Content-Type", "application/x-ndjson")
+	} else {
+		httpRsp.Header().Set("Content-Type", "application/json")
+	}
 
 	// Begin
-	data := []byte(time.Now().UTC().Format("2006-01-02T15:04:05Z") + " watching " + target + "\n")
+	data := []byte(time.Now().UTC().Format("2006-01-02T15:04:05Z") + " watching " + opts.name() + "\n")
+	if ndjson {
+		data = ndjsonBannerLine(opts)
+	}
 	httpRsp.Write(data)
 
 	// Generate a unique watcher ID
-	watcherID := watcherCreate(target)
+	watcherID := watcherCreate(opts)
 
 	// Data watching loop
 	for {
@@ -38,14 +75,46 @@ func watch(httpRsp http.ResponseWriter, httpReq *http.Request, target string) {
 			break
 		}
 
-		// Get more data from the watcher, using a timeout computed by trial and
-		// error as a reasonable amount of time to catch an error on the Write
-		// when the client has gone away.  Longer than that, sometimes the response
-		// time in picking up an error becomes quite unpredictable and long.
-		data, err := watcherGet(watcherID, 16*time.Second)
-		if err != nil {
+		// Get more data from the watcher, sending a heartbeat if there is none
+		// for a while.  The request's context is done as soon as the client goes
+		// away, at which point the watcher is reclaimed.
+		events, err := watcherGet(httpReq.Context(), watcherID, 16*time.Second)
+		if err != nil && !watcherFinal(err) {
 			break
 		}
+		final := watcherFinal(err)
+
+		// With NDJSON framing, each event and each heartbeat is a line of its own
+		if ndjson {
+			data = ndjsonEventLines(events)
+			if len(data) == 0 {
+				data = ndjsonHeartbeatLine()
+			}
+			_, err = httpRsp.Write(data)
+			if err != nil || final {
+				break
+			}
+			continue
+		}
+
+		data = nil
+		for _, evt := range events {
+			if evt.shutdown {
+				data = append(data, []byte(time.Now().UTC().Format("2006-01-02T15:04:05Z")+" shutting down\n")...)
+				continue
+			}
+			if evt.dropped > 0 {
+				data = append(data, []byte(fmt.Sprintf("%s %d events dropped\n", time.Now().UTC().Format("2006-01-02T15:04:05Z"), evt.dropped))...)
+				continue
+			}
+			var indented bytes.Buffer
+			content := evt.content(opts)
+			if json.Indent(&indented, content, "", "    ") == nil {
+				data = append(data, indented.Bytes()...)
+			} else {
+				data = append(data, content...)
+			}
+		}
 		if len(data) == 0 {
 			data = []byte(time.Now().UTC().Format("2006-01-02T15:04:05Z") + " idle")
 		}
@@ -55,7 +124,7 @@ func watch(httpRsp http.ResponseWriter, httpReq *http.Request, target string) {
 		// the HTTP client goes away
 		data = append(data, []byte("\n")...)
 		_, err = httpRsp.Write(data)
-		if err != nil {
+		if err != nil || final {
 			break
 		}
 
@@ -65,3 +134,120 @@ func watch(httpRsp http.ResponseWriter, httpReq *http.Request, target string) {
 	watcherDelete(watcherID)
 
 }
+
+// Options that apply to a watch, regardless of its transport
+type watchOptions struct {
+
+	// The targets watched, either by name or by patterns that their names match
+	targets  []string
+	patterns []string
+
+	// The token presented by the client, which must grant read access to any
+	// target matching a pattern for its records to be delivered
+	token string
+
+	// The cursor at which the watch begins, either a record sequence number or a
+	// receive time, or neither if only live records are wanted
+	fromSeq int64
+	since   time.Time
+
+	// Deliver only records matching this filter, or all records if nil
+	where *filter
+
+	// Deliver each record wrapped in its envelope of sequence number and receive time
+	meta bool
+
+	// The number of events that may be queued for a slow client, and what to
+	// do with those beyond that
+	queue int
+	slow  string
+
+	// The framing of the plain stream, either text for people or NDJSON for
+	// programs
+	framing string
+}
+
+// Parse the options for a watch.  A reconnecting EventSource sends the ID of
+// the last event it saw, which is the sequence number of a record, and so
+// resumes from the one after it.  Otherwise a client may ask for all records
+// from a sequence number or since a time.
+func watchParseOptions(httpReq *http.Request, args map[string]string) (opts watchOptions, err error) {
+
+	lastEventID := httpReq.Header.Get("Last-Event-ID")
+	if lastEventID == "" {
+		lastEventID = args["lastEventId"]
+	}
+	if lastEventID != "" {
+		opts.fromSeq, err = strconv.ParseInt(lastEventID, 10, 64)
+		if err != nil {
+			err = fmt.Errorf("can't parse last event ID %s: %s", lastEventID, err)
+			return
+		}
+		opts.fromSeq++
+	}
+
+	if args["from"] != "" {
+		opts.fromSeq, err = strconv.ParseInt(args["from"], 10, 64)
+		if err != nil {
+			err = fmt.Errorf("can't parse from %s: %s", args["from"], err)
+			return
+		}
+	}
+
+	if args["since"] != "" {
+		opts.since, err = parseTime(args["since"])
+		if err != nil {
+			return
+		}
+	}
+
+	opts.where, err = filterParse(args["where"])
+	if err != nil {
+		return
+	}
+
+	opts.meta = args["meta"] != ""
+
+	opts.token = authPresented(httpReq, args)
+
+	opts.framing = args["framing"]
+	switch opts.framing {
+	case "":
+		opts.framing = framingText
+	case framingText, framingNDJSON:
+	default:
+		err = fmt.Errorf("framing must be %s or %s", framingText, framingNDJSON)
+		return
+	}
+
+	if args["queue"] != "" {
+		opts.queue, err = strconv.Atoi(args["queue"])
+		if err != nil || opts.queue <= 0 {
+			err = fmt.Errorf("invalid queue length: %s", args["queue"])
+			return
+		}
+	}
+
+	opts.slow = args["slow"]
+	switch opts.slow {
+	case "":
+		opts.slow = slowDropOldest
+	case slowDropOldest, slowDropNewest, slowDisconnect:
+	default:
+		err = fmt.Errorf("slow must be %s, %s or %s", slowDropOldest, slowDropNewest, slowDisconnect)
+		return
+	}
+
+	return
+}
+
+// Determine whether a watch is of anything other than a single target, in
+// which case each event is delivered along with the target it was posted to
+func (opts watchOptions) multi() bool {
+	return len(opts.targets) != 1 || len(opts.patterns) > 0
+}
+
+// Describe the targets of a watch
+func (opts watchOptions) name() string {
+	return strings.Join(append(append([]string{}, opts.targets...), opts.patterns...), ",")
+}
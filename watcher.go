@@ -5,38 +5,247 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"path"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/google/uuid"
 )
 
-// The active watcher data structure
+// Maximum number of events queued for a watcher whose client isn't keeping up
+const configMaxWatcherQueue = 1000
+
+// What to do with an event for a watcher whose queue is full
+const (
+	slowDropOldest = "drop-oldest"
+	slowDropNewest = "drop-newest"
+	slowDisconnect = "disconnect"
+)
+
+// Returned, along with the last of its events, to a watcher that was
+// disconnected for falling behind
+var errWatcherOverflow = errors.New("watcher fell too far behind")
+
+// Returned, along with the last of its events and a final marker event, to a
+// watcher whose watch is ending because the service is shutting down
+var errWatcherShutdown = errors.New("service is shutting down")
+
+// A single item delivered to watchers, identified by the sequence number
+// of the stored record so that clients may resume after a reconnect.  If
+// events were dropped because the watcher fell behind, a marker event
+// carrying the number dropped takes their place.  The last event delivered
+// before the service shuts down is a marker saying so.
+type watchEvent struct {
+	target   string
+	id       int64
+	received string
+	data     []byte
+	dropped  int
+	shutdown bool
+}
+
+// The envelope in which an event is delivered when its metadata is wanted,
+// which is that of the stored record along with, for watches of more than
+// one target, the target to which it was posted
+type watchEnvelope struct {
+	Target   string          `json:"target,omitempty"`
+	Seq      int64           `json:"seq"`
+	Received string          `json:"received"`
+	Payload  json.RawMessage `json:"payload"`
+}
+
+// Convert a stored record of a target to the event delivered to watchers
+func watchEventFromRecord(target string, rec storedRecord) watchEvent {
+	return watchEvent{target: target, id: rec.Seq, received: rec.Received, data: rec.Payload}
+}
+
+// Get the data to be delivered for an event, wrapped in its envelope if the
+// client asked for record metadata or is watching more than one target
+func (evt watchEvent) content(opts watchOptions) []byte {
+	if !opts.meta && !opts.multi() {
+		return evt.data
+	}
+	envelope := watchEnvelope{Seq: evt.id, Received: evt.received, Payload: evt.data}
+	if opts.multi() {
+		envelope.Target = evt.target
+	}
+	envelopeJSON, err := json.Marshal(envelope)
+	if err != nil {
+		return evt.data
+	}
+	return envelopeJSON
+}
+
+// The active watcher data structure.  Each watcher's queue has its own lock,
+// so that delivering to one watcher never waits on another.
 type activeWatcher struct {
-	watcherID string
-	target    string
-	event     *Event
-	buf       []byte
+	watcherID  string
+	name       string
+	targets    map[string]bool
+	patterns   []string
+	token      string
+	event      *Event
+	where      *filter
+	lock       sync.Mutex
+	buf        []watchEvent
+	limit      int
+	policy     string
+	dropped    int
+	overflowed bool
+	closing    bool
+}
+
+// The hub through which records are published to watchers.  Watchers are
+// indexed by ID, for their own use, and by target, so that publishing a
+// record visits only the watchers of its target along with those watching
+// targets matching a pattern.
+type watchHub struct {
+	lock      sync.RWMutex
+	closing   bool
+	byID      map[string]*activeWatcher
+	byTarget  map[string]map[*activeWatcher]bool
+	byPattern map[*activeWatcher]bool
+}
+
+var watchers = watchHub{
+	byID:      map[string]*activeWatcher{},
+	byTarget:  map[string]map[*activeWatcher]bool{},
+	byPattern: map[*activeWatcher]bool{},
+}
+
+// Determine whether a watcher watches a target by way of one of its patterns,
+// which requires that the watcher may read it
+func (watcher *activeWatcher) matches(target string) bool {
+	for _, pattern := range watcher.patterns {
+		matched, _ := path.Match(pattern, target)
+		if matched {
+			return scopeRank[authScope(target, watcher.token)] >= scopeRank[scopeRead]
+		}
+	}
+	return false
 }
 
-var watchers = []activeWatcher{}
-var watcherLock sync.RWMutex
+// Find a watcher by ID
+func watcherFind(watcherID string) (watcher *activeWatcher) {
+	watchers.lock.RLock()
+	watcher = watchers.byID[watcherID]
+	watchers.lock.RUnlock()
+	return
+}
 
-// Create a new watcher
-func watcherCreate(target string) (watcherID string) {
+// Create a new watcher of the targets and target patterns of a watch.  If a
+// cursor is supplied (a starting sequence number and/or a starting time), the
+// watcher is first loaded with the stored records at or after that cursor,
+// followed by whatever arrived live in the meantime, within the limit of its
+// queue.  Only records matching the watch's filter, if any, are delivered.
+func watcherCreate(opts watchOptions) (watcherID string) {
 
 	watcherID = uuid.New().String()
 
-	watcher := activeWatcher{}
+	watcher := &activeWatcher{}
 	watcher.watcherID = watcherID
-	watcher.target = target
+	watcher.name = opts.name()
+	watcher.targets = map[string]bool{}
+	for _, target := range opts.targets {
+		watcher.targets[target] = true
+	}
+	watcher.patterns = opts.patterns
+	watcher.token = opts.token
 	watcher.event = EventNew()
+	watcher.where = opts.where
+	watcher.limit = opts.queue
+	if watcher.limit <= 0 || watcher.limit > configMaxWatcherQueue {
+		watcher.limit = configMaxWatcherQueue
+	}
+	watcher.policy = opts.slow
+
+	// Register the watcher before reading the backlog, so that nothing posted
+	// while we are reading is missed
+	watchers.lock.Lock()
+	watchers.byID[watcherID] = watcher
+	for target := range watcher.targets {
+		subscribers := watchers.byTarget[target]
+		if subscribers == nil {
+			subscribers = map[*activeWatcher]bool{}
+			watchers.byTarget[target] = subscribers
+		}
+		subscribers[watcher] = true
+	}
+	if len(watcher.patterns) > 0 {
+		watchers.byPattern[watcher] = true
+	}
+	if watchers.closing {
+		watcher.closing = true
+		watcher.event.Signal()
+	}
+	fmt.Printf("watchers: %s added (now %d)\n", watcher.name, len(watchers.byID))
+	watchers.lock.Unlock()
+
+	if opts.fromSeq <= 0 && opts.since.IsZero() {
+		return
+	}
+
+	// Find the targets whose backlog is wanted, including those that already
+	// exist and match a pattern
+	targets := append([]string{}, opts.targets...)
+	if len(watcher.patterns) > 0 {
+		for _, target := range tailTargets() {
+			if !watcher.targets[target] && watcher.matches(target) {
+				targets = append(targets, target)
+			}
+		}
+	}
+
+	// Read the backlog and place it ahead of anything received live, dropping
+	// live events that were also found on disk.  The backlogs of several
+	// targets are merged in the order in which their records were received.
+	var replay []watchEvent
+	lastSeq := map[string]int64{}
+	found := 0
+	for _, target := range targets {
+		records := recordsFrom(target, opts.fromSeq, opts.since)
+		for _, rec := range records {
+			if opts.where.match(rec.Payload) {
+				replay = append(replay, watchEventFromRecord(target, rec))
+			}
+			lastSeq[target] = rec.Seq
+		}
+		found += len(records)
+	}
+	if found == 0 {
+		return
+	}
+	if len(targets) > 1 {
+		sort.SliceStable(replay, func(i, j int) bool {
+			return replay[i].received < replay[j].received
+		})
+	}
+	fmt.Printf("watchers: %s replaying %d\n", watcher.name, len(replay))
 
-	watcherLock.Lock()
-	watchers = append(watchers, watcher)
-	fmt.Printf("watchers: %s added (now %d)\n", watcher.target, len(watchers))
-	watcherLock.Unlock()
+	// The backlog is queued just as live events are, so that the watcher's
+	// queue limit and slow-consumer policy apply to it too
+	watcher.lock.Lock()
+	live := watcher.buf
+	watcher.buf = nil
+	for _, evt := range replay {
+		watcher.enqueue(evt)
+	}
+	for _, evt := range live {
+		if evt.id > lastSeq[evt.target] {
+			watcher.enqueue(evt)
+		}
+	}
+	queued := len(watcher.buf) > 0 || watcher.dropped > 0
+	watcher.lock.Unlock()
+	if queued {
+		watcher.event.Signal()
+	}
 
 	return
 }
@@ -44,71 +253,178 @@ func watcherCreate(target string) (watcherID string) {
 // Delete a watcher
 func watcherDelete(watcherID string) {
 
-	watcherLock.Lock()
-	numWatchers := len(watchers)
-	for i, watcher := range watchers {
-		if watcher.watcherID == watcherID {
-			if i == numWatchers-1 {
-				watchers = watchers[0:i]
-			} else {
-				watchers = append(watchers[0:i], watchers[i+1:]...)
+	watchers.lock.Lock()
+	watcher := watchers.byID[watcherID]
+	if watcher != nil {
+		delete(watchers.byID, watcherID)
+		for target := range watcher.targets {
+			subscribers := watchers.byTarget[target]
+			delete(subscribers, watcher)
+			if len(subscribers) == 0 {
+				delete(watchers.byTarget, target)
 			}
-			fmt.Printf("watchers: %s removed (now %d)\n", watcher.target, len(watchers))
-			break
 		}
+		delete(watchers.byPattern, watcher)
+		fmt.Printf("watchers: %s removed (now %d)\n", watcher.name, len(watchers.byID))
 	}
-	watcherLock.Unlock()
+	watchers.lock.Unlock()
 
 }
 
-// Get data from a watcher
-func watcherGet(watcherID string, timeout time.Duration) (data []byte, err error) {
-	var watcher activeWatcher
+// Get the events pending for a watcher, waiting up to the timeout for some
+// to arrive, or until the context is done because the client has gone away.
+// If events were dropped, a marker is placed where they would have been:
+// ahead of the queue if the oldest were dropped, else after it.
+func watcherGet(ctx context.Context, watcherID string, timeout time.Duration) (events []watchEvent, err error) {
+
+	watcher := watcherFind(watcherID)
+	if watcher == nil {
+		err = fmt.Errorf("watcher not found")
+		return
+	}
+
+	watcher.event.WaitContext(ctx, timeout)
+	err = ctx.Err()
+	if err != nil {
+		return
+	}
 
-	// Find the watcher
-	watcherLock.Lock()
-	for _, watcher = range watchers {
-		if watcher.watcherID == watcherID {
-			break
+	// Take whatever is queued, first clearing the signal so that anything
+	// queued after this signals anew, but what is taken now doesn't signal
+	// again
+	watcher.event.Reset()
+	watcher.lock.Lock()
+	events = watcher.buf
+	watcher.buf = nil
+	if watcher.dropped > 0 {
+		marker := watchEvent{dropped: watcher.dropped}
+		if watcher.policy == slowDropOldest {
+			events = append([]watchEvent{marker}, events...)
+		} else {
+			events = append(events, marker)
 		}
+		fmt.Printf("watchers: %s dropped %d\n", watcher.name, watcher.dropped)
+		watcher.dropped = 0
 	}
-	watcherLock.Unlock()
+	if watcher.overflowed {
+		err = errWatcherOverflow
+	}
+	if watcher.closing {
+		events = append(events, watchEvent{shutdown: true})
+		err = errWatcherShutdown
+	}
+	watcher.lock.Unlock()
 
-	// If not found, we're done
-	if watcher.watcherID != watcherID {
-		err = fmt.Errorf("watcher not found")
+	return
+
+}
+
+// Determine whether an error from watcherGet ends the watch only once the
+// events returned along with it have been delivered
+func watcherFinal(err error) bool {
+	return err == errWatcherOverflow || err == errWatcherShutdown
+}
+
+// Tell all watchers, and any created from now on, that the service is
+// shutting down, so that each delivers what it has queued followed by a
+// final event and then ends
+func watcherShutdown() {
+	watchers.lock.Lock()
+	watchers.closing = true
+	for _, watcher := range watchers.byID {
+		watcher.lock.Lock()
+		watcher.closing = true
+		watcher.lock.Unlock()
+		watcher.event.Signal()
+	}
+	fmt.Printf("watchers: %d told of shutdown\n", len(watchers.byID))
+	watchers.lock.Unlock()
+}
+
+// Queue an event for a watcher, applying its policy if the queue is full,
+// with the watcher's lock held
+func (watcher *activeWatcher) enqueue(evt watchEvent) {
+
+	if watcher.overflowed {
+		watcher.dropped++
 		return
 	}
+	if len(watcher.buf) < watcher.limit {
+		watcher.buf = append(watcher.buf, evt)
+		return
+	}
+
+	watcher.dropped++
+	switch watcher.policy {
+	case slowDropNewest:
+	case slowDisconnect:
+		watcher.overflowed = true
+	default:
+		watcher.buf = append(watcher.buf[1:], evt)
+	}
+
+}
 
-	// Wait with timeout
-	watcher.event.Wait(timeout)
+// Publish a record to the watchers of its target
+func watcherPut(target string, rec storedRecord) {
 
-	// Get the buffer
-	watcherLock.Lock()
-	for i := range watchers {
-		if watchers[i].watcherID == watcherID {
-			data = watchers[i].buf
-			watchers[i].buf = []byte{}
-			break
+	// Deliver to a watcher, unmarshaling the payload at most once for filtering
+	evt := watchEventFromRecord(target, rec)
+	var obj interface{}
+	unmarshaled := false
+	deliver := func(watcher *activeWatcher) {
+		if watcher.where != nil {
+			if !unmarshaled {
+				json.Unmarshal(rec.Payload, &obj)
+				unmarshaled = true
+			}
+			if !watcher.where.matchObject(obj) {
+				return
+			}
 		}
+		watcher.lock.Lock()
+		watcher.enqueue(evt)
+		watcher.lock.Unlock()
+		watcher.event.Signal()
 	}
-	watcherLock.Unlock()
 
-	return
+	// Visit the target's watchers, and then those watching patterns that
+	// weren't already visited for naming the target itself
+	watchers.lock.RLock()
+	for watcher := range watchers.byTarget[target] {
+		deliver(watcher)
+	}
+	for watcher := range watchers.byPattern {
+		if !watcher.targets[target] && watcher.matches(target) {
+			deliver(watcher)
+		}
+	}
+	watchers.lock.RUnlock()
 
 }
 
-// Append data from a watcher
-func watcherPut(target string, data []byte) {
+// Count the live watchers, and those of each target and of each pattern
+func watcherCounts() (total int, byTarget map[string]int, byPattern map[string]int) {
 
-	// Scan all watchers
-	watcherLock.Lock()
-	for i := range watchers {
-		if watchers[i].target == target {
-			watchers[i].buf = append(watchers[i].buf, data...)
-			watchers[i].event.Signal()
+	watchers.lock.RLock()
+	defer watchers.lock.RUnlock()
+
+	total = len(watchers.byID)
+	byTarget = map[string]int{}
+	for target, subscribers := range watchers.byTarget {
+		byTarget[target] = len(subscribers)
+	}
+	byPattern = map[string]int{}
+	for watcher := range watchers.byPattern {
+		for _, pattern := range watcher.patterns {
+			byPattern[pattern]++
 		}
 	}
-	watcherLock.Unlock()
 
+	return
+}
+
+// Determine whether a watch target is a pattern rather than a single target
+func watchIsPattern(target string) bool {
+	return strings.ContainsAny(target, "*?")
 }
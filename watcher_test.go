@@ -0,0 +1,108 @@
+// Copyright 2020 Blues Inc.  All rights reserved.
+// Use of this source code is governed by licenses granted by the
+// copyright holder including that found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Benchmark the fan-out of records to watchers, with each watcher drained by
+// its own goroutine as a client's connection would be.  Each operation is one
+// record published with watcherPut and delivered by watcherGet to every
+// watcher of its target, with the watchers either all on one target or spread
+// across many.  Events dropped because a watcher fell behind are reported.
+func BenchmarkWatchers(b *testing.B) {
+	for _, n := range []int{1000, 5000, 10000} {
+		for _, targets := range []int{1, 100} {
+			b.Run(fmt.Sprintf("watchers=%d/targets=%d", n, targets), func(b *testing.B) {
+				benchmarkWatchers(b, n, targets)
+			})
+		}
+	}
+}
+
+func benchmarkWatchers(b *testing.B, n int, targets int) {
+
+	defer testQuiet()()
+
+	names := make([]string, targets)
+	for i := range names {
+		names[i] = fmt.Sprintf("bench-%d", i)
+	}
+	ids := make([]string, n)
+	for i := range ids {
+		ids[i] = watcherCreate(watchOptions{targets: []string{names[i%targets]}})
+	}
+	defer func() {
+		for _, id := range ids {
+			watcherDelete(id)
+		}
+	}()
+
+	// Each watcher expects every record published to its target, counting
+	// those it was told were dropped
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var wg sync.WaitGroup
+	var dropped atomic.Int64
+	for i, id := range ids {
+		want := b.N / targets
+		if i%targets < b.N%targets {
+			want++
+		}
+		wg.Add(1)
+		go func(id string, want int) {
+			defer wg.Done()
+			for got := 0; got < want; {
+				events, _ := watcherGet(ctx, id, time.Second)
+				if ctx.Err() != nil {
+					return
+				}
+				for _, evt := range events {
+					if evt.dropped > 0 {
+						got += evt.dropped
+						dropped.Add(int64(evt.dropped))
+					} else {
+						got++
+					}
+				}
+			}
+		}(id, want)
+	}
+
+	rec := storedRecord{Received: time.Now().UTC().Format(time.RFC3339Nano), Payload: json.RawMessage(`{"bench":true}`)}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		rec.Seq = int64(i + 1)
+		watcherPut(names[i%targets], rec)
+	}
+	wg.Wait()
+	b.StopTimer()
+
+	b.ReportMetric(float64(dropped.Load())/float64(b.N), "dropped/op")
+
+}
+
+// Discard what is logged while watchers are created and deleted, returning a
+// function that restores it
+func testQuiet() (restore func()) {
+	stdout := os.Stdout
+	devnull, err := os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+	if err != nil {
+		return func() {}
+	}
+	os.Stdout = devnull
+	return func() {
+		os.Stdout = stdout
+		devnull.Close()
+	}
+}